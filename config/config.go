@@ -1,7 +1,10 @@
 package config
 
 import (
+	"fmt"
+	"net"
 	"os"
+	"path/filepath"
 	"time"
 
 	"gopkg.in/yaml.v3"
@@ -12,17 +15,103 @@ type Config struct {
 		Port         string        `yaml:"port"`
 		ReadTimeout  time.Duration `yaml:"read_timeout"`
 		WriteTimeout time.Duration `yaml:"write_timeout"`
+		// Сколько при остановке ждать завершения выполняющихся задач, прежде чем прервать их
+		ShutdownTimeout time.Duration `yaml:"shutdown_timeout"`
+		// Токен для /api/v1/admin, передается в заголовке Authorization: Bearer; пустой - админский API выключен
+		AdminToken string `yaml:"admin_token"`
 	} `yaml:"server"`
 
 	Limits struct {
 		MaxConcurrentTasks int `yaml:"max_concurrent_tasks"`
 		MaxFilesPerTask    int `yaml:"max_files_per_task"`
-		MaxFileSizeMB      int `yaml:"max_file_size_mb"`
+		MaxFileSizeMB      int `yaml:"max_file_size_mb"` // 0 - без ограничения
+		MaxTaskSizeMB      int `yaml:"max_task_size_mb"` // Суммарный размер файлов задачи, 0 - без ограничения
 	} `yaml:"limits"`
 
+	Storage struct {
+		DownloadDir string `yaml:"download_dir"`
+		Backend     string `yaml:"backend"`    // memory - задачи теряются при перезапуске, file - сохраняются в state_file
+		StateFile   string `yaml:"state_file"` // Файл с задачами для backend: file
+	} `yaml:"storage"`
+
+	Archive struct {
+		Mode              string `yaml:"mode"`                 // disk - архив собирается на диске, stream - файлы пишутся в архив прямо из источника
+		ReadAhead         bool   `yaml:"read_ahead"`           // В режиме stream скачивать следующий файл заранее
+		ReadAheadMemoryMB int    `yaml:"read_ahead_memory_mb"` // Сколько МБ заранее скачанного файла держать в памяти
+	} `yaml:"archive"`
+
+	Download struct {
+		MinChunkSizeKB        int `yaml:"min_chunk_size_kb"`        // Минимальный размер чанка; файл меньше двух чанков скачивается одним запросом
+		MaxChunkSizeMB        int `yaml:"max_chunk_size_mb"`        // Максимальный размер чанка, 0 - без ограничения
+		MaxConnections        int `yaml:"max_connections"`          // Сколько запросов к источникам идет одновременно со всех задач, 0 - без ограничения
+		MaxConnectionsPerHost int `yaml:"max_connections_per_host"` // То же для одного хоста; столько же максимум чанков у одного файла
+		MaxParallelFiles      int `yaml:"max_parallel_files"`       // Сколько файлов одной задачи скачивается одновременно
+	} `yaml:"download"`
+
+	Throttle ThrottleLimits `yaml:"throttle"`
+
+	Retry RetryPolicy `yaml:"retry"`
+
+	Retention struct {
+		IdleTTL         time.Duration `yaml:"idle_ttl"`           // Срок хранения незапущенных (created) и прерванных (aborted) задач
+		CompletedTTL    time.Duration `yaml:"completed_ttl"`      // Срок хранения выполненных задач вместе с архивом
+		FailedTTL       time.Duration `yaml:"failed_ttl"`         // Срок хранения задач, завершившихся ошибкой или отмененных
+		SweepInterval   time.Duration `yaml:"sweep_interval"`     // Как часто проверять сроки хранения
+		DiskHighWaterMB int           `yaml:"disk_high_water_mb"` // Объем download_dir, при превышении которого старые задачи удаляются досрочно
+	} `yaml:"retention"` // Нулевой срок или объем означает отсутствие ограничения
+
+	Egress EgressPolicy `yaml:"egress"`
+
 	AllowedTypes []string `yaml:"allowed_types"`
 }
 
+// Хранилища задач
+const (
+	StoreBackendMemory = "memory"
+	StoreBackendFile   = "file"
+)
+
+// Режимы сборки архива
+const (
+	ArchiveModeDisk   = "disk"
+	ArchiveModeStream = "stream"
+)
+
+// ThrottleLimits ограничивает скорость загрузки файлов и отдачи архивов, в байтах в секунду;
+// 0 - без ограничения. Лимиты можно менять на ходу через /api/v1/admin/throttle.
+type ThrottleLimits struct {
+	Global  int64 `yaml:"global_bytes_per_sec" json:"global_bytes_per_sec"` // На весь сервер
+	PerTask int64 `yaml:"task_bytes_per_sec" json:"task_bytes_per_sec"`     // На каждую задачу
+	PerHost int64 `yaml:"host_bytes_per_sec" json:"host_bytes_per_sec"`     // На каждый хост-источник
+}
+
+// Validate проверяет, что лимиты не отрицательные
+func (l ThrottleLimits) Validate() error {
+	if l.Global < 0 || l.PerTask < 0 || l.PerHost < 0 {
+		return fmt.Errorf("throttle limits must not be negative")
+	}
+	return nil
+}
+
+// RetryPolicy описывает повторные попытки запросов к серверу-источнику
+type RetryPolicy struct {
+	MaxAttempts       int           `yaml:"max_attempts"`       // Всего попыток, включая первую
+	BaseBackoff       time.Duration `yaml:"base_backoff"`       // Пауза перед второй попыткой, далее удваивается
+	MaxBackoff        time.Duration `yaml:"max_backoff"`        // Верхняя граница паузы, в том числе из Retry-After
+	Jitter            float64       `yaml:"jitter"`             // Случайное отклонение паузы, доля от 0 до 1
+	RetryableStatuses []int         `yaml:"retryable_statuses"` // HTTP-статусы, после которых запрос повторяется
+}
+
+// EgressPolicy ограничивает адреса, к которым сервис обращается по ссылкам пользователей
+type EgressPolicy struct {
+	AllowedSchemes []string `yaml:"allowed_schemes"` // По умолчанию http и https
+	AllowedHosts   []string `yaml:"allowed_hosts"`   // Если список задан, разрешены только эти хосты; "*.example.com" - вместе с поддоменами
+	DeniedHosts    []string `yaml:"denied_hosts"`    // Запрещенные хосты в том же формате
+	AllowedCIDRs   []string `yaml:"allowed_cidrs"`   // Исключения из встроенного запрета внутренних адресов (loopback, частные сети, link-local)
+	DeniedCIDRs    []string `yaml:"denied_cidrs"`    // Дополнительно запрещенные сети
+	MaxRedirects   int      `yaml:"max_redirects"`   // По умолчанию 5, отрицательное значение запрещает редиректы
+}
+
 func Load(configPath string) (*Config, error) {
 	config := &Config{}
 
@@ -37,5 +126,73 @@ func Load(configPath string) (*Config, error) {
 		return nil, err
 	}
 
+	if config.Server.ShutdownTimeout <= 0 {
+		config.Server.ShutdownTimeout = 30 * time.Second
+	}
+
+	if config.Storage.DownloadDir == "" {
+		config.Storage.DownloadDir = "./downloads"
+	}
+	if config.Storage.Backend == "" {
+		config.Storage.Backend = StoreBackendMemory
+	}
+	if config.Storage.StateFile == "" {
+		config.Storage.StateFile = filepath.Join(config.Storage.DownloadDir, "tasks.json")
+	}
+
+	if len(config.AllowedTypes) == 0 {
+		config.AllowedTypes = []string{".pdf", ".jpeg", ".jpg"}
+	}
+
+	if config.Archive.Mode == "" {
+		config.Archive.Mode = ArchiveModeDisk
+	}
+
+	if config.Download.MinChunkSizeKB < 0 {
+		config.Download.MinChunkSizeKB = 0
+	}
+	if config.Download.MaxChunkSizeMB < 0 {
+		config.Download.MaxChunkSizeMB = 0
+	}
+	if config.Download.MaxConnections < 0 {
+		config.Download.MaxConnections = 0
+	}
+	if config.Download.MaxConnectionsPerHost <= 0 {
+		config.Download.MaxConnectionsPerHost = 10
+	}
+	if config.Download.MaxParallelFiles <= 0 {
+		config.Download.MaxParallelFiles = 1
+	}
+
+	if err := config.Throttle.Validate(); err != nil {
+		return nil, err
+	}
+
+	if config.Retention.SweepInterval <= 0 {
+		config.Retention.SweepInterval = time.Minute
+	}
+
+	if config.Retry.MaxAttempts < 1 {
+		config.Retry.MaxAttempts = 1
+	}
+	if config.Retry.MaxBackoff == 0 {
+		config.Retry.MaxBackoff = 30 * time.Second
+	}
+
+	if len(config.Egress.AllowedSchemes) == 0 {
+		config.Egress.AllowedSchemes = []string{"http", "https"}
+	}
+	if config.Egress.MaxRedirects == 0 {
+		config.Egress.MaxRedirects = 5
+	}
+	if config.Egress.MaxRedirects < 0 {
+		config.Egress.MaxRedirects = 0
+	}
+	for _, block := range append(config.Egress.AllowedCIDRs, config.Egress.DeniedCIDRs...) {
+		if _, _, err := net.ParseCIDR(block); err != nil {
+			return nil, fmt.Errorf("invalid egress CIDR %q: %v", block, err)
+		}
+	}
+
 	return config, nil
-}
\ No newline at end of file
+}
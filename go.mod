@@ -4,4 +4,4 @@ go 1.23.5
 
 require github.com/google/uuid v1.6.0
 
-require gopkg.in/yaml.v3 v3.0.1 // indirect
+require gopkg.in/yaml.v3 v3.0.1
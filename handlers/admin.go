@@ -0,0 +1,54 @@
+package handlers
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	"github.com/vldmir/zip-service/config"
+)
+
+// authorizeAdmin проверяет токен из server.admin_token в заголовке Authorization: Bearer.
+// Без настроенного токена админский API выключен.
+func authorizeAdmin(w http.ResponseWriter, r *http.Request) bool {
+	if cfg.Server.AdminToken == "" {
+		writeError(w, http.StatusForbidden, CodeAdminDisabled, "Admin API is disabled, set server.admin_token to enable it", nil)
+		return false
+	}
+
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok || subtle.ConstantTimeCompare([]byte(token), []byte(cfg.Server.AdminToken)) != 1 {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		writeError(w, http.StatusUnauthorized, CodeUnauthorized, "Invalid or missing admin token", nil)
+		return false
+	}
+	return true
+}
+
+// ThrottleHandler возвращает (GET) или заменяет (PUT) лимиты скорости загрузки и отдачи архивов.
+// Новые лимиты сразу действуют и на уже идущие передачи, но не сохраняются в config.yaml.
+func ThrottleHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" && r.Method != "PUT" {
+		methodNotAllowed(w, "GET, PUT")
+		return
+	}
+	if !authorizeAdmin(w, r) {
+		return
+	}
+
+	if r.Method == "PUT" {
+		var limits config.ThrottleLimits
+		if err := json.NewDecoder(r.Body).Decode(&limits); err != nil {
+			writeError(w, http.StatusBadRequest, CodeBadRequest, "Invalid JSON body: "+err.Error(), nil)
+			return
+		}
+		if err := limits.Validate(); err != nil {
+			writeError(w, http.StatusBadRequest, CodeBadRequest, err.Error(), nil)
+			return
+		}
+		storage.Throttle().SetLimits(limits)
+	}
+
+	json.NewEncoder(w).Encode(storage.Throttle().Limits())
+}
@@ -1,128 +1,425 @@
 package handlers
 
 import (
-	"archive/zip"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"github.com/vldmir/zip-service/manager"
 	"io"
 	"log"
 	"net/http"
-	"net/url"
 	"os"
-	"path/filepath"
 	"strings"
+	"time"
+
 	"github.com/vldmir/zip-service/config"
+	"github.com/vldmir/zip-service/manager"
 	"github.com/vldmir/zip-service/service"
 )
 
 var (
 	storage *service.LinkService
+	pool    *manager.Pool
+	janitor *service.Janitor
 	cfg     *config.Config
 )
 
-func InitHandlers(config *config.Config) {
+func InitHandlers(config *config.Config) error {
 	cfg = config
-	storage = service.New(config) // Инициализируем storage с конфигом
+
+	store, err := service.NewTaskStore(config)
+	if err != nil {
+		return err
+	}
+	storage = service.New(config, store) // Инициализируем storage с конфигом
+
+	// Все загрузки делят общий лимит соединений с источниками
+	sched := service.NewConnScheduler(config.Download.MaxConnections, config.Download.MaxConnectionsPerHost)
+	pool = manager.NewPool(storage, service.NewHTTPClient(config.Retry, storage.Egress(), sched), config.Limits.MaxConcurrentTasks)
+
+	// Задача, набравшая максимум ссылок, сразу уходит в фоновую обработку.
+	// Фоновые воркеры собирают архив на диске, поэтому в режиме stream задача остается created
+	// и выполняется запросом архива.
+	if !streamMode() {
+		storage.OnTaskFull(func(taskID string) {
+			if err := pool.Submit(taskID); err != nil {
+				log.Printf("Failed to auto-start task %s: %v", taskID, err)
+			}
+		})
+	}
+
+	// Задачи, прерванные перезапуском сервера, продолжаются с места остановки;
+	// в режиме stream - следующим запросом архива
+	for _, taskID := range storage.Recover() {
+		if streamMode() {
+			continue
+		}
+		if err := pool.Submit(taskID); err != nil {
+			log.Printf("Failed to resume task %s: %v", taskID, err)
+			continue
+		}
+		log.Printf("Resuming task %s interrupted by restart", taskID)
+	}
+
+	// Задачи с истекшим сроком хранения удаляются в фоне вместе с файлами
+	janitor = service.StartJanitor(storage)
+	return nil
+}
+
+// streamMode сообщает, что архивы по умолчанию пишутся потоком в ответ на запрос архива
+func streamMode() bool {
+	return cfg.Archive.Mode == config.ArchiveModeStream
+}
+
+// Drain перестает принимать новые задачи и ждет завершения выполняющихся загрузок и потоковых архивов.
+// Когда ctx отменен, оставшиеся задачи прерываются и помечаются прерванными.
+func Drain(ctx context.Context) error {
+	return pool.Shutdown(ctx)
+}
+
+// Close останавливает фоновую уборку, сохраняет состояние задач и удаляет ненужные временные файлы.
+// Вызывается после Drain, когда обработчики запросов уже завершились.
+func Close() error {
+	janitor.Stop()
+	return storage.Close()
 }
 
 type TaskResponse struct {
-	TaskID string `json:"task_id"`
+	TaskID  string       `json:"task_id"`
+	Results []LinkResult `json:"results,omitempty"`
+}
+
+// taskIDFrom возвращает ID задачи из пути /api/v1/tasks/{id} или из параметра ?task= старых маршрутов
+func taskIDFrom(r *http.Request) string {
+	if id := r.PathValue("id"); id != "" {
+		return id
+	}
+	return r.URL.Query().Get("task")
+}
+
+// archiveURL возвращает адрес архива задачи в том же варианте API, через который пришел запрос
+func archiveURL(r *http.Request, taskID string) string {
+	if strings.HasPrefix(r.URL.Path, "/api/") {
+		return "/api/v1/tasks/" + taskID + "/archive"
+	}
+	return "/task/download-archive?task=" + taskID
+}
+
+// LinkInput - ссылка в теле запроса: строка с адресом или объект {"link": "...", "name": "...", "checksum": "..."}
+type LinkInput struct {
+	Link     string `json:"link"`
+	Name     string `json:"name"`     // Необязательное имя файла в архиве
+	Checksum string `json:"checksum"` // Необязательный ожидаемый хеш: "sha256:<hex>" или "md5:<hex>"
+}
+
+func (l *LinkInput) UnmarshalJSON(data []byte) error {
+	if len(data) > 0 && data[0] == '"' {
+		return json.Unmarshal(data, &l.Link)
+	}
+	type plain LinkInput
+	return json.Unmarshal(data, (*plain)(l))
+}
+
+// LinkResult - результат добавления одной ссылки из списка
+type LinkResult struct {
+	Link     string `json:"link"`
+	Accepted bool   `json:"accepted"`
+	Code     string `json:"code,omitempty"` // Код ошибки, как в ErrorResponse
+	Error    string `json:"error,omitempty"`
+}
+
+// addLinks добавляет ссылки в задачу и возвращает результат по каждой из них
+func addLinks(taskID string, inputs []LinkInput) ([]LinkResult, error) {
+	links := make([]service.NewLink, len(inputs))
+	for i, input := range inputs {
+		links[i] = service.NewLink{URL: input.Link, Name: input.Name, Checksum: input.Checksum}
+	}
+
+	errs, err := storage.AddLinks(taskID, links)
+	if err != nil {
+		return nil, err
+	}
+
+	results := make([]LinkResult, len(inputs))
+	for i, input := range inputs {
+		results[i] = LinkResult{Link: input.Link, Accepted: errs[i] == nil}
+		if errs[i] != nil {
+			_, results[i].Code = classify(errs[i])
+			results[i].Error = errs[i].Error()
+		}
+	}
+	return results, nil
+}
+
+// accepted сообщает, принята ли хотя бы одна ссылка
+func accepted(results []LinkResult) bool {
+	for _, result := range results {
+		if result.Accepted {
+			return true
+		}
+	}
+	return false
+}
+
+// TaskStatusResponse - ответ GET /task/status с состоянием задачи и каждой её ссылки
+type TaskStatusResponse struct {
+	TaskID     string             `json:"task_id"`
+	Status     service.TaskStatus `json:"status"`
+	Error      string             `json:"error,omitempty"`
+	LinksCount int                `json:"links_count"`
+	Links      []service.Link     `json:"links"`
+	ArchiveURL string             `json:"archive_url,omitempty"`
 }
 
-// CreateTaskHandler создает новую задачу для загрузки файлов
+// CreateTaskHandler создает новую задачу для загрузки файлов.
+// Необязательное тело {"links": [...]} сразу добавляет в задачу начальные ссылки.
 func CreateTaskHandler(w http.ResponseWriter, r *http.Request) {
 	if r.Method != "POST" {
-		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		methodNotAllowed(w, "POST")
 		return
 	}
-	
-	if storage.ActiveTasksCount() >= cfg.Limits.MaxConcurrentTasks {
-		http.Error(w, "Server busy: too many active tasks", http.StatusTooManyRequests)
+
+	// Во время остановки сервера новые задачи не принимаются
+	if pool.Closed() {
+		writeServiceError(w, service.ErrShuttingDown)
 		return
 	}
 
+	var data struct {
+		Links []LinkInput `json:"links"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&data); err != nil && err != io.EOF {
+		writeError(w, http.StatusBadRequest, CodeBadRequest, "Invalid JSON body: "+err.Error(), nil)
+		return
+	}
 
-	taskID := storage.CreateTask()
-	json.NewEncoder(w).Encode(TaskResponse{TaskID: taskID})
+	taskID, err := storage.CreateTask()
+	if err != nil {
+		writeServiceError(w, err)
+		return
+	}
+
+	response := TaskResponse{TaskID: taskID}
+	if len(data.Links) > 0 {
+		if response.Results, err = addLinks(taskID, data.Links); err != nil {
+			writeServiceError(w, err)
+			return
+		}
+	}
+	json.NewEncoder(w).Encode(response)
 }
 
-// AddLinkHandler добавляет ссылку в указанную задачу
+// AddLinkHandler добавляет в указанную задачу одну ссылку {"link": "..."}
+// или список {"links": [...]} с результатом по каждой ссылке
 func AddLinkHandler(w http.ResponseWriter, r *http.Request) {
 	if r.Method != "POST" {
-		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		methodNotAllowed(w, "POST")
 		return
 	}
 
-	taskID := r.URL.Query().Get("task")
+	taskID := taskIDFrom(r)
 	if taskID == "" {
-		http.Error(w, "Task ID is required", http.StatusBadRequest)
+		taskIDRequired(w)
 		return
 	}
 
 	var data struct {
-		Link string `json:"link"`
+		Link     string      `json:"link"`
+		Name     string      `json:"name"`     // Необязательное имя файла в архиве
+		Checksum string      `json:"checksum"` // Необязательный ожидаемый хеш
+		Links    []LinkInput `json:"links"`
 	}
 
 	if err := json.NewDecoder(r.Body).Decode(&data); err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
+		writeError(w, http.StatusBadRequest, CodeBadRequest, "Invalid JSON body: "+err.Error(), nil)
 		return
 	}
 
-	if err := storage.AddLink(taskID, data.Link); err != nil {
-		http.Error(w, err.Error(), http.StatusNotFound)
+	if data.Links != nil {
+		addLinksBatch(w, taskID, data.Links)
+		return
+	}
+
+	if err := storage.AddLink(taskID, data.Link, data.Name, data.Checksum); err != nil {
+		writeServiceError(w, err)
+		return
+	}
+
+	task, err := storage.GetTask(taskID)
+	if err != nil {
+		writeServiceError(w, err)
 		return
 	}
 
 	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"task_id":     task.ID,
+		"status":      task.Status,
+		"links_count": len(task.Links),
+	})
 }
 
-// DownloadAndArchiveHandler обрабатывает загрузку и архивацию файлов для задачи
-func DownloadAndArchiveHandler(w http.ResponseWriter, r *http.Request) {
-	if r.Method != "GET" {
-		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+// addLinksBatch добавляет список ссылок и отвечает результатом по каждой из них.
+// Если не принята ни одна ссылка, отвечает ошибкой 422 с результатами в details.
+func addLinksBatch(w http.ResponseWriter, taskID string, inputs []LinkInput) {
+	results, err := addLinks(taskID, inputs)
+	if err != nil {
+		writeServiceError(w, err)
+		return
+	}
+
+	task, err := storage.GetTask(taskID)
+	if err != nil {
+		writeServiceError(w, err)
+		return
+	}
+
+	if !accepted(results) {
+		writeError(w, http.StatusUnprocessableEntity, CodeNoLinksAccepted, "No links were accepted", map[string]interface{}{
+			"results": results,
+		})
+		return
+	}
+
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"task_id":     task.ID,
+		"status":      task.Status,
+		"links_count": len(task.Links),
+		"results":     results,
+	})
+}
+
+// StartTaskHandler ставит задачу в очередь фоновых воркеров на загрузку и архивацию.
+// В режиме stream задача выполняется только запросом архива, поэтому запуск отклоняется.
+func StartTaskHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		methodNotAllowed(w, "POST")
+		return
+	}
+	if streamMode() {
+		writeError(w, http.StatusConflict, CodeTaskState, "Tasks are not started in archive stream mode, request the archive to stream it", nil)
+		return
+	}
+
+	taskID := taskIDFrom(r)
+	if taskID == "" {
+		taskIDRequired(w)
+		return
+	}
+
+	if _, err := storage.GetTask(taskID); err != nil {
+		writeServiceError(w, err)
+		return
+	}
+
+	if err := pool.Submit(taskID); err != nil {
+		writeServiceError(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(map[string]string{
+		"task_id": taskID,
+		"status":  string(service.StatusQueued),
+	})
+}
+
+// DeleteTaskHandler отменяет выполнение задачи, удаляет её недокачанные файлы и саму задачу
+func DeleteTaskHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "DELETE" {
+		methodNotAllowed(w, "DELETE")
 		return
 	}
 
-	taskID := r.URL.Query().Get("task")
+	taskID := taskIDFrom(r)
 	if taskID == "" {
-		http.Error(w, "Task ID is required", http.StatusBadRequest)
+		taskIDRequired(w)
 		return
 	}
 
-	// Получаем ссылки для задачи
-	linkStrings, err := storage.GetLinks(taskID)
+	if _, err := storage.GetTask(taskID); err != nil {
+		writeServiceError(w, err)
+		return
+	}
+
+	// Завершенную задачу отменять уже нечего - её просто удаляем
+	if err := pool.Cancel(taskID); err != nil {
+		log.Printf("Task %s was not cancelled: %v", taskID, err)
+	}
+
+	task, err := storage.GetTask(taskID)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusNotFound)
+		writeServiceError(w, err)
 		return
 	}
 
-	// Конвертируем строки в URL
-	var links []*url.URL
-	for _, linkStr := range linkStrings {
-		u, err := url.Parse(linkStr)
-		if err != nil {
-			log.Printf("Error parsing URL %s: %v", linkStr, err)
-			continue
-		}
-		links = append(links, u)
+	if err := storage.ClearTask(taskID); err != nil {
+		writeServiceError(w, err)
+		return
 	}
 
+	json.NewEncoder(w).Encode(map[string]string{
+		"task_id": task.ID,
+		"status":  string(task.Status),
+	})
+}
 
-	// Указываем директорию для загрузки
-	downloadDir := "./downloads"
-	if _, err := os.Stat(downloadDir); os.IsNotExist(err) {
-		if err := os.Mkdir(downloadDir, 0755); err != nil {
-			log.Printf("Failed to create download directory: %v", err)
-			http.Error(w, "Internal server error", http.StatusInternalServerError)
-			return
-		}
+// TasksHandler обслуживает /api/v1/tasks: создание (POST) и список (GET) задач
+func TasksHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "POST":
+		CreateTaskHandler(w, r)
+	case "GET":
+		ListTasksHandler(w, r)
+	default:
+		methodNotAllowed(w, "GET, POST")
 	}
+}
 
-	// Загружаем файлы
-	manager.Run(links, downloadDir)
+// TaskHandler обслуживает /api/v1/tasks/{id}: статус (GET) и удаление (DELETE) задачи
+func TaskHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET":
+		GetTaskStatusHandler(w, r)
+	case "DELETE":
+		DeleteTaskHandler(w, r)
+	default:
+		methodNotAllowed(w, "GET, DELETE")
+	}
+}
+
+// DownloadAndArchiveHandler отдает готовый архив задачи.
+// Если задача еще не запускалась, она выполняется синхронно, как раньше.
+// В режиме stream (archive.mode в конфиге или ?mode=stream) файлы пишутся
+// в архив прямо из источника без сохранения на диск.
+func DownloadAndArchiveHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		methodNotAllowed(w, "GET")
+		return
+	}
+
+	taskID := taskIDFrom(r)
+	if taskID == "" {
+		taskIDRequired(w)
+		return
+	}
+
+	mode := cfg.Archive.Mode
+	if m := r.URL.Query().Get("mode"); m != "" {
+		mode = m
+	}
+	if mode != config.ArchiveModeDisk && mode != config.ArchiveModeStream {
+		writeError(w, http.StatusBadRequest, CodeBadRequest, fmt.Sprintf("Unknown archive mode %q", mode), nil)
+		return
+	}
+
+	task, err := storage.GetTask(taskID)
+	if err != nil {
+		writeServiceError(w, err)
+		return
+	}
 
-	// Создаем архив
 	archiveName := "downloads.zip"
 	if filename := r.URL.Query().Get("filename"); filename != "" {
 		archiveName = filename
@@ -131,74 +428,202 @@ func DownloadAndArchiveHandler(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
-	// Устанавливаем заголовки для потоковой передачи архива
-	w.Header().Set("Content-Type", "application/zip")
-	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%s", archiveName))
+	// Незапущенная или прерванная задача выполняется в рамках запроса:
+	// отключение клиента отменяет r.Context() и прерывает загрузку.
+	// Выполненная в режиме stream задача не хранит архив и выполняется заново.
+	runnable := task.Status == service.StatusCreated || task.Status == service.StatusAborted ||
+		(task.Status == service.StatusCompleted && task.ArchivePath == "")
+
+	if runnable && pool.Closed() {
+		writeServiceError(w, service.ErrShuttingDown)
+		return
+	}
 
-	// Создаем ZIP-архив напрямую в ResponseWriter
-	zipWriter := zip.NewWriter(w)
-	defer zipWriter.Close()
+	// Загрузка файлов и отдача архива, тем более с ограничением скорости, идут дольше write_timeout,
+	// поэтому таймаут отсчитывается заново перед каждой записью
+	w = newDeadlineResponse(w, cfg.Server.WriteTimeout)
 
-	// Проходим по файлам в папке
-	err = filepath.Walk(downloadDir, func(filePath string, info os.FileInfo, err error) error {
-		if err != nil {
-			return err
-		}
+	if runnable && mode == config.ArchiveModeStream {
+		w.Header().Set("Content-Type", "application/zip")
+		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%s", archiveName))
 
-		// Пропускаем директории и архивы
-		if info.IsDir() || strings.HasSuffix(filePath, ".zip") {
-			return nil
+		opts := manager.StreamOptions{
+			ReadAhead:       cfg.Archive.ReadAhead,
+			ReadAheadMemory: int64(cfg.Archive.ReadAheadMemoryMB) << 20,
 		}
-
-		fileToZip, err := os.Open(filePath)
-		if err != nil {
-			return fmt.Errorf("failed to open file %s: %v", filePath, err)
+		counter := &countingWriter{w: w}
+		out, release := storage.Throttle().ArchiveWriter(r.Context(), taskID, counter)
+		defer release()
+		if err := pool.StreamNow(r.Context(), taskID, out, opts); err != nil {
+			// Задача не запустилась (лимит, состояние, остановка сервера) или упала до первого байта -
+			// передача еще не началась, и можно ответить ошибкой
+			if counter.n == 0 && r.Context().Err() == nil {
+				w.Header().Del("Content-Disposition")
+				writeServiceError(w, err)
+				return
+			}
+			// Мы не можем изменить статус ответа, так как уже начали передачу данных
+			log.Printf("Task %s failed during streaming: %v", taskID, err)
 		}
-		defer fileToZip.Close()
+		return
+	}
 
-		// Создаем запись в архиве
-		relPath, _ := filepath.Rel(downloadDir, filePath)
-		header, err := zip.FileInfoHeader(info)
-		if err != nil {
-			return fmt.Errorf("failed to create zip header for %s: %v", filePath, err)
+	if runnable {
+		if err := pool.RunNow(r.Context(), taskID); err != nil {
+			if errors.Is(err, service.ErrServerBusy) {
+				writeServiceError(w, err)
+				return
+			}
+			log.Printf("Task %s failed: %v", taskID, err)
+			if r.Context().Err() != nil {
+				return
+			}
 		}
-		header.Name = relPath
-		header.Method = zip.Deflate
-
-		writer, err := zipWriter.CreateHeader(header)
-		if err != nil {
-			return fmt.Errorf("failed to create writer for %s: %v", filePath, err)
+		if task, err = storage.GetTask(taskID); err != nil {
+			writeServiceError(w, err)
+			return
 		}
+	}
 
-		_, err = io.Copy(writer, fileToZip)
-		return err
-	})
+	switch task.Status {
+	case service.StatusCompleted:
+	case service.StatusFailed:
+		writeError(w, http.StatusInternalServerError, CodeTaskFailed, fmt.Sprintf("Task failed: %s", task.Error), nil)
+		return
+	default:
+		writeError(w, http.StatusConflict, CodeTaskState, fmt.Sprintf("Archive is not ready, task is %s", task.Status), nil)
+		return
+	}
 
+	archive, err := os.Open(task.ArchivePath)
 	if err != nil {
-		log.Printf("Error during archiving: %v", err)
-		// Мы не можем изменить статус ответа, так как уже начали передачу данных
-		fmt.Fprintf(w, "\nError during archiving: %v", err)
+		log.Printf("Failed to open archive of task %s: %v", taskID, err)
+		writeError(w, http.StatusInternalServerError, CodeInternal, "Internal server error", nil)
+		return
+	}
+	defer archive.Close()
+
+	info, err := archive.Stat()
+	if err != nil {
+		log.Printf("Failed to stat archive of task %s: %v", taskID, err)
+		writeError(w, http.StatusInternalServerError, CodeInternal, "Internal server error", nil)
+		return
 	}
+
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%s", archiveName))
+	throttled, release := storage.Throttle().ArchiveWriter(r.Context(), taskID, w)
+	defer release()
+	http.ServeContent(throttledResponse{ResponseWriter: w, w: throttled}, r, archiveName, info.ModTime(), archive)
+}
+
+// countingWriter считает записанные байты, чтобы понять, началась ли передача ответа
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// throttledResponse пишет тело ответа через ограничитель скорости
+type throttledResponse struct {
+	http.ResponseWriter
+	w io.Writer
+}
+
+func (t throttledResponse) Write(p []byte) (int, error) {
+	return t.w.Write(p)
+}
+
+// deadlineResponse продлевает срок записи ответа на timeout перед каждой записью.
+// Долгая отдача архива не обрывается, а клиент, переставший читать, отключается по таймауту одной записи.
+type deadlineResponse struct {
+	http.ResponseWriter
+	rc      *http.ResponseController
+	timeout time.Duration
+}
+
+func newDeadlineResponse(w http.ResponseWriter, timeout time.Duration) http.ResponseWriter {
+	if timeout <= 0 {
+		return w
+	}
+	return &deadlineResponse{ResponseWriter: w, rc: http.NewResponseController(w), timeout: timeout}
+}
+
+func (d *deadlineResponse) Write(p []byte) (int, error) {
+	if err := d.rc.SetWriteDeadline(time.Now().Add(d.timeout)); err != nil && !errors.Is(err, http.ErrNotSupported) {
+		return 0, err
+	}
+	return d.ResponseWriter.Write(p)
+}
+
+// Unwrap дает http.ResponseController доступ к исходному ResponseWriter
+func (d *deadlineResponse) Unwrap() http.ResponseWriter {
+	return d.ResponseWriter
 }
 
 // GetTaskStatusHandler возвращает статус задачи
 func GetTaskStatusHandler(w http.ResponseWriter, r *http.Request) {
 	if r.Method != "GET" {
-		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		methodNotAllowed(w, "GET")
 		return
 	}
 
-	taskID := r.URL.Query().Get("task")
+	taskID := taskIDFrom(r)
 	if taskID == "" {
-		http.Error(w, "Task ID is required", http.StatusBadRequest)
+		taskIDRequired(w)
 		return
 	}
 
-	count, err := storage.GetTaskStatus(taskID)
+	task, err := storage.GetTask(taskID)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusNotFound)
+		writeServiceError(w, err)
+		return
+	}
+
+	json.NewEncoder(w).Encode(statusResponse(r, task))
+}
+
+// ListTasksHandler возвращает состояние всех задач в порядке создания,
+// с необязательным фильтром по состоянию ?status=
+func ListTasksHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		methodNotAllowed(w, "GET")
 		return
 	}
 
-	json.NewEncoder(w).Encode(map[string]int{"links_count": count})
+	filter := service.TaskStatus(r.URL.Query().Get("status"))
+
+	tasks := make([]TaskStatusResponse, 0)
+	for _, task := range storage.ListTasks() {
+		if filter != "" && task.Status != filter {
+			continue
+		}
+		tasks = append(tasks, statusResponse(r, task))
+	}
+
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"tasks": tasks,
+	})
+}
+
+// statusResponse собирает ответ о состоянии задачи и её ссылок
+func statusResponse(r *http.Request, task service.Task) TaskStatusResponse {
+	response := TaskStatusResponse{
+		TaskID:     task.ID,
+		Status:     task.Status,
+		Error:      task.Error,
+		LinksCount: len(task.Links),
+		Links:      task.Links,
+	}
+	// В режиме stream архив можно запросить, как только задача набрала все ссылки
+	full := task.Status == service.StatusCreated && len(task.Links) >= cfg.Limits.MaxFilesPerTask
+	if task.Status == service.StatusCompleted || (streamMode() && full) {
+		response.ArchiveURL = archiveURL(r, task.ID)
+	}
+	return response
 }
@@ -0,0 +1,105 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+
+	"github.com/vldmir/zip-service/service"
+)
+
+// Коды ошибок API. Код стабилен и предназначен для программной обработки,
+// текст сообщения может меняться.
+const (
+	CodeBadRequest       = "bad_request"
+	CodeMethodNotAllowed = "method_not_allowed"
+	CodeNotFound         = "not_found"
+	CodeTaskNotFound     = "task_not_found"
+	CodeTaskState        = "invalid_task_state"
+	CodeTooManyFiles     = "too_many_files"
+	CodeUnsupportedType  = "unsupported_type"
+	CodeInvalidLink      = "invalid_link"
+	CodeLinkNotAllowed   = "link_not_allowed"
+	CodeNoLinksAccepted  = "no_links_accepted"
+	CodeServerBusy       = "server_busy"
+	CodeShuttingDown     = "shutting_down"
+	CodeUnauthorized     = "unauthorized"
+	CodeAdminDisabled    = "admin_disabled"
+	CodeTaskFailed       = "task_failed"
+	CodeInternal         = "internal_error"
+)
+
+// ErrorResponse - единый формат ответа с ошибкой для всех обработчиков
+type ErrorResponse struct {
+	Code    string      `json:"code"`
+	Message string      `json:"message"`
+	Details interface{} `json:"details,omitempty"`
+}
+
+// serviceErrors сопоставляет ошибкам сервиса HTTP-статус и код ответа
+var serviceErrors = []struct {
+	err    error
+	status int
+	code   string
+}{
+	{service.ErrTaskNotFound, http.StatusNotFound, CodeTaskNotFound},
+	{service.ErrTaskState, http.StatusConflict, CodeTaskState},
+	{service.ErrTooManyFiles, http.StatusRequestEntityTooLarge, CodeTooManyFiles},
+	{service.ErrUnsupportedType, http.StatusUnsupportedMediaType, CodeUnsupportedType},
+	{service.ErrInvalidLink, http.StatusUnprocessableEntity, CodeInvalidLink},
+	{service.ErrEgressDenied, http.StatusUnprocessableEntity, CodeLinkNotAllowed},
+	{service.ErrServerBusy, http.StatusTooManyRequests, CodeServerBusy},
+	{service.ErrShuttingDown, http.StatusServiceUnavailable, CodeShuttingDown},
+}
+
+// classify возвращает HTTP-статус и код ответа для ошибки сервиса
+func classify(err error) (int, string) {
+	for _, e := range serviceErrors {
+		if errors.Is(err, e.err) {
+			return e.status, e.code
+		}
+	}
+	return http.StatusInternalServerError, CodeInternal
+}
+
+// writeError отвечает ошибкой в формате ErrorResponse
+func writeError(w http.ResponseWriter, status int, code, message string, details interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(ErrorResponse{
+		Code:    code,
+		Message: message,
+		Details: details,
+	})
+}
+
+// writeServiceError отвечает ошибкой сервиса со статусом и кодом, соответствующими её типу.
+// Текст непредвиденных ошибок не раскрывается клиенту и только пишется в лог.
+func writeServiceError(w http.ResponseWriter, err error) {
+	status, code := classify(err)
+	if status == http.StatusInternalServerError {
+		log.Printf("Internal error: %v", err)
+		writeError(w, status, code, "Internal server error", nil)
+		return
+	}
+	writeError(w, status, code, err.Error(), nil)
+}
+
+// methodNotAllowed отвечает ошибкой 405. Маршруты регистрируются без метода,
+// чтобы неподходящий метод получал ответ в формате ErrorResponse, а не текстовый ответ ServeMux.
+func methodNotAllowed(w http.ResponseWriter, allowed string) {
+	w.Header().Set("Allow", allowed)
+	writeError(w, http.StatusMethodNotAllowed, CodeMethodNotAllowed, "Method not allowed", nil)
+}
+
+// NotFoundHandler отвечает ошибкой 404 в формате ErrorResponse на неизвестные пути API
+func NotFoundHandler(w http.ResponseWriter, r *http.Request) {
+	writeError(w, http.StatusNotFound, CodeNotFound, fmt.Sprintf("Unknown API path %s", r.URL.Path), nil)
+}
+
+// taskIDRequired отвечает ошибкой 400, если в запросе нет ID задачи
+func taskIDRequired(w http.ResponseWriter) {
+	writeError(w, http.StatusBadRequest, CodeBadRequest, "Task ID is required", nil)
+}
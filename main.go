@@ -1,10 +1,13 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"log"
 	"net/http"
 	"os"
+	"os/signal"
+	"syscall"
 	"time"
 	"github.com/vldmir/zip-service/config"
 	"github.com/vldmir/zip-service/handlers"
@@ -29,10 +32,22 @@ func printWelcomeMessage() {
 
 func printRoutes() {
 	fmt.Println("Available endpoints:")
+	fmt.Println("POST   /api/v1/tasks               - Create new download task")
+	fmt.Println("GET    /api/v1/tasks               - List tasks")
+	fmt.Println("GET    /api/v1/tasks/{id}          - Check task status")
+	fmt.Println("POST   /api/v1/tasks/{id}/links    - Add links to task")
+	fmt.Println("POST   /api/v1/tasks/{id}/start    - Start task in background")
+	fmt.Println("GET    /api/v1/tasks/{id}/archive  - Download archive")
+	fmt.Println("DELETE /api/v1/tasks/{id}          - Cancel and delete task")
+	fmt.Println("GET    /api/v1/admin/throttle      - Show bandwidth limits")
+	fmt.Println("PUT    /api/v1/admin/throttle      - Change bandwidth limits")
+	fmt.Println("Legacy endpoints:")
 	fmt.Println("POST   /task/create              - Create new download task")
 	fmt.Println("POST   /links/add?task=<task_id> - Add link to task")
+	fmt.Println("POST   /task/start?task=<task_id> - Start task in background")
 	fmt.Println("GET    /task/status?task=<task_id> - Check task status")
 	fmt.Println("GET    /task/download-archive?task=<task_id> - Download archive")
+	fmt.Println("DELETE /task?task=<task_id>       - Cancel and delete task")
 	fmt.Println("----------------------------------------")
 }
 
@@ -56,11 +71,15 @@ func main() {
 	}
 
 	// Инициализация обработчиков с конфигом
-	handlers.InitHandlers(cfg)
+	if err := handlers.InitHandlers(cfg); err != nil {
+		log.Fatalf("Failed to initialize handlers: %v", err)
+	}
 
 	// Настройка сервера с таймаутами
+	mux := http.NewServeMux()
 	srv := &http.Server{
 		Addr:         cfg.Server.Port,
+		Handler:      mux,
 		ReadTimeout:  cfg.Server.ReadTimeout,
 		WriteTimeout: cfg.Server.WriteTimeout,
 	}
@@ -69,17 +88,64 @@ func main() {
 	printRoutes()
 	printServerInfo(cfg.Server.Port)
 
-	http.HandleFunc("/task/create", handlers.CreateTaskHandler)
-	http.HandleFunc("/links/add", handlers.AddLinkHandler)
-	http.HandleFunc("/task/download-archive", handlers.DownloadAndArchiveHandler)
-	http.HandleFunc("/task/status", handlers.GetTaskStatusHandler)
+	// Маршруты без метода: метод проверяют обработчики и отвечают на неподходящий ошибкой в JSON
+	mux.HandleFunc("/api/v1/tasks", handlers.TasksHandler)
+	mux.HandleFunc("/api/v1/tasks/{id}", handlers.TaskHandler)
+	mux.HandleFunc("/api/v1/tasks/{id}/links", handlers.AddLinkHandler)
+	mux.HandleFunc("/api/v1/tasks/{id}/start", handlers.StartTaskHandler)
+	mux.HandleFunc("/api/v1/tasks/{id}/archive", handlers.DownloadAndArchiveHandler)
+	mux.HandleFunc("/api/v1/admin/throttle", handlers.ThrottleHandler)
+	mux.HandleFunc("/api/v1/", handlers.NotFoundHandler)
+
+	// Старые маршруты с ?task= оставлены для совместимости
+	mux.HandleFunc("/task/create", handlers.CreateTaskHandler)
+	mux.HandleFunc("/links/add", handlers.AddLinkHandler)
+	mux.HandleFunc("/task/start", handlers.StartTaskHandler)
+	mux.HandleFunc("/task/download-archive", handlers.DownloadAndArchiveHandler)
+	mux.HandleFunc("/task/status", handlers.GetTaskStatusHandler)
+	mux.HandleFunc("/task", handlers.DeleteTaskHandler)
 
 	log.Printf("Starting server on %s with configuration:\n", cfg.Server.Port)
 	log.Printf("- Max concurrent tasks: %d\n", cfg.Limits.MaxConcurrentTasks)
 	log.Printf("- Max files per task: %d\n", cfg.Limits.MaxFilesPerTask)
 	log.Printf("- Allowed file types: %v\n", cfg.AllowedTypes)
 
-	if err := srv.ListenAndServe(); err != nil {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	serveErr := make(chan error, 1)
+	go func() {
+		serveErr <- srv.ListenAndServe()
+	}()
+
+	select {
+	case err := <-serveErr:
 		log.Fatalf("Server failed: %v", err)
+	case <-ctx.Done():
+	}
+	stop()
+
+	// Перестаем принимать запросы и даем выполняющимся задачам shutdown_timeout на завершение;
+	// не успевшие задачи прерываются и после перезапуска могут быть продолжены
+	log.Printf("Shutting down, waiting up to %s for running tasks", cfg.Server.ShutdownTimeout)
+	drainCtx, cancel := context.WithTimeout(context.Background(), cfg.Server.ShutdownTimeout)
+	defer cancel()
+
+	httpDone := make(chan error, 1)
+	go func() {
+		httpDone <- srv.Shutdown(drainCtx)
+	}()
+
+	if err := handlers.Drain(drainCtx); err != nil {
+		log.Printf("Running tasks did not finish in time and were aborted")
+	}
+	if err := <-httpDone; err != nil {
+		log.Printf("Failed to close connections gracefully: %v", err)
+		srv.Close()
+	}
+
+	if err := handlers.Close(); err != nil {
+		log.Printf("Failed to save tasks: %v", err)
 	}
+	log.Printf("Server stopped")
 }
\ No newline at end of file
@@ -0,0 +1,121 @@
+package manager
+
+import (
+	"archive/zip"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/vldmir/zip-service/service"
+	"github.com/vldmir/zip-service/util"
+)
+
+// ArchiveFileName - имя готового архива внутри рабочей директории задачи
+const ArchiveFileName = "archive.zip"
+
+// zipFlagUTF8 - бит 11 флагов записи ZIP: имя записи в кодировке UTF-8
+const zipFlagUTF8 = 0x800
+
+// BuildArchive упаковывает скачанные файлы рабочей директории в архив на диске.
+// names[idx] - имя в архиве для файла ссылки idx, пустое имя означает, что файл в архив не попадает.
+// Архив сначала пишется во временный файл, чтобы наполовину записанный zip никогда не отдавался клиенту.
+func BuildArchive(ctx context.Context, srcDir string, names []string) (string, error) {
+	archivePath := filepath.Join(srcDir, ArchiveFileName)
+	tmpPath := archivePath + ".tmp"
+
+	out, err := os.Create(tmpPath)
+	if err != nil {
+		return "", fmt.Errorf("failed to create archive %s: %v", tmpPath, err)
+	}
+
+	if err := WriteArchive(ctx, out, srcDir, names); err != nil {
+		out.Close()
+		os.Remove(tmpPath)
+		return "", err
+	}
+
+	if err := out.Close(); err != nil {
+		os.Remove(tmpPath)
+		return "", fmt.Errorf("failed to close archive %s: %v", tmpPath, err)
+	}
+
+	if err := os.Rename(tmpPath, archivePath); err != nil {
+		return "", fmt.Errorf("failed to finalize archive %s: %v", archivePath, err)
+	}
+
+	return archivePath, nil
+}
+
+// EntryNames назначает скачанным ссылкам задачи уникальные имена записей архива в порядке добавления ссылок:
+// повторяющееся имя получает суффикс ("book (1).pdf"). Для нескачанных ссылок возвращается пустое имя.
+func EntryNames(links []service.Link) []string {
+	names := make([]string, len(links))
+	used := make(map[string]bool)
+	for idx, link := range links {
+		if link.State != service.LinkDone {
+			continue
+		}
+		name := link.FileName
+		if name == "" {
+			name = "file"
+		}
+		names[idx] = util.UniqueName(name, used)
+	}
+	return names
+}
+
+// WriteArchive записывает ZIP-архив с файлами рабочей директории в w под именами из names.
+// Отмена ctx прерывает архивацию перед следующим файлом.
+func WriteArchive(ctx context.Context, w io.Writer, srcDir string, names []string) error {
+	zipWriter := zip.NewWriter(w)
+
+	for idx, name := range names {
+		if name == "" {
+			continue
+		}
+		if err := ctx.Err(); err != nil {
+			zipWriter.Close()
+			return fmt.Errorf("error during archiving: %v", err)
+		}
+
+		if err := addFile(zipWriter, filepath.Join(srcDir, storedName(idx)), name); err != nil {
+			zipWriter.Close()
+			return fmt.Errorf("error during archiving: %v", err)
+		}
+	}
+
+	return zipWriter.Close()
+}
+
+// addFile добавляет файл filePath в архив под именем name
+func addFile(zipWriter *zip.Writer, filePath, name string) error {
+	fileToZip, err := os.Open(filePath)
+	if err != nil {
+		return fmt.Errorf("failed to open file %s: %v", filePath, err)
+	}
+	defer fileToZip.Close()
+
+	info, err := fileToZip.Stat()
+	if err != nil {
+		return fmt.Errorf("failed to stat file %s: %v", filePath, err)
+	}
+
+	// Создаем запись в архиве
+	header, err := zip.FileInfoHeader(info)
+	if err != nil {
+		return fmt.Errorf("failed to create zip header for %s: %v", filePath, err)
+	}
+	header.Name = name
+	header.Method = zip.Deflate
+	header.Flags |= zipFlagUTF8
+
+	writer, err := zipWriter.CreateHeader(header)
+	if err != nil {
+		return fmt.Errorf("failed to create writer for %s: %v", filePath, err)
+	}
+
+	_, err = io.Copy(writer, fileToZip)
+	return err
+}
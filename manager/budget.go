@@ -0,0 +1,108 @@
+package manager
+
+import (
+	"fmt"
+	"sync"
+)
+
+// budget следит за лимитами размера в рамках одного запуска задачи:
+// max_file_size_mb для каждого файла и max_task_size_mb для всех файлов вместе.
+// Нулевой лимит означает отсутствие ограничения.
+type budget struct {
+	fileLimit int64
+	taskLimit int64
+
+	mu   sync.Mutex
+	used int64 // Зарезервировано по Content-Length или фактически скачано
+}
+
+func newBudget(maxFileSizeMB, maxTaskSizeMB int) *budget {
+	return &budget{
+		fileLimit: int64(maxFileSizeMB) << 20,
+		taskLimit: int64(maxTaskSizeMB) << 20,
+	}
+}
+
+// fileBudget - учет размера одного файла
+type fileBudget struct {
+	b        *budget
+	reserved int64 // Зарезервировано по заявленному размеру
+	written  int64 // Фактически получено байт
+}
+
+// reserve проверяет заявленный сервером размер файла и резервирует его в бюджете задачи.
+// Для файлов неизвестного размера (declared <= 0) байты учитываются по мере загрузки.
+func (b *budget) reserve(declared int64) (*fileBudget, error) {
+	if declared < 0 {
+		declared = 0
+	}
+	if b.fileLimit > 0 && declared > b.fileLimit {
+		return nil, fmt.Errorf("file size %d bytes exceeds max_file_size_mb limit of %d MB", declared, b.fileLimit>>20)
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.taskLimit > 0 && b.used+declared > b.taskLimit {
+		return nil, fmt.Errorf("file size %d bytes exceeds remaining task budget: %d of %d MB already used", declared, b.used>>20, b.taskLimit>>20)
+	}
+	b.used += declared
+
+	return &fileBudget{b: b, reserved: declared}, nil
+}
+
+// charge учитывает в бюджете задачи файл размером size, скачанный при предыдущем запуске.
+// Файл уже лежит на диске и попадет в архив, поэтому учитывается без проверки лимита.
+func (b *budget) charge(size int64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.used += size
+}
+
+// add учитывает n полученных байт и прерывает загрузку, если сервер прислал больше,
+// чем разрешают лимиты, даже когда он занизил или не сообщил Content-Length
+func (f *fileBudget) add(n int) error {
+	// Чанки файла и файлы задачи качаются параллельно, поэтому учет ведется под общей блокировкой
+	f.b.mu.Lock()
+	defer f.b.mu.Unlock()
+
+	prev := f.written
+	f.written += int64(n)
+
+	if f.b.fileLimit > 0 && f.written > f.b.fileLimit {
+		return fmt.Errorf("file exceeds max_file_size_mb limit of %d MB", f.b.fileLimit>>20)
+	}
+
+	// Байты сверх зарезервированного размера дополнительно списываются с бюджета задачи
+	extra := f.written - max(prev, f.reserved)
+	if extra <= 0 {
+		return nil
+	}
+
+	f.b.used += extra
+	if f.b.taskLimit > 0 && f.b.used > f.b.taskLimit {
+		return fmt.Errorf("task exceeds max_task_size_mb budget of %d MB", f.b.taskLimit>>20)
+	}
+	return nil
+}
+
+// reset обнуляет учет полученных байт, когда файл начинают скачивать заново
+func (f *fileBudget) reset() {
+	f.b.mu.Lock()
+	defer f.b.mu.Unlock()
+
+	if f.written > f.reserved {
+		f.b.used -= f.written - f.reserved
+	}
+	f.written = 0
+}
+
+// release возвращает в бюджет задачи место файла, который не попадет в архив
+func (f *fileBudget) release() {
+	f.b.mu.Lock()
+	defer f.b.mu.Unlock()
+
+	f.b.used -= max(f.written, f.reserved)
+	f.reserved = 0
+	f.written = 0
+}
@@ -0,0 +1,105 @@
+package manager
+
+import (
+	"fmt"
+	"hash"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+
+	"github.com/vldmir/zip-service/service"
+	"github.com/vldmir/zip-service/util"
+)
+
+// integrityAttempts - сколько раз скачивается файл, не прошедший проверку целостности
+const integrityAttempts = 2
+
+// setOrigin запоминает ожидаемый хеш из заголовков ответа сервера, описывающих файл целиком
+func (j *linkJob) setOrigin(header http.Header) {
+	if sum, ok := service.OriginChecksum(header); ok {
+		j.origin = &sum
+	}
+}
+
+// expected возвращает ожидаемый хеш файла: заданный клиентом важнее присланного сервером
+func (j *linkJob) expected() *service.Checksum {
+	if j.checksum != "" {
+		if sum, err := service.ParseChecksum(j.checksum); err == nil {
+			return &sum
+		}
+	}
+	return j.origin
+}
+
+// newHash создает хеш для проверки файла: того же алгоритма, что и ожидаемый, или sha256
+func (j *linkJob) newHash() (hash.Hash, string) {
+	alg := service.ChecksumSHA256
+	if want := j.expected(); want != nil {
+		alg = want.Algorithm
+	}
+	return service.NewHash(alg), alg
+}
+
+// checkIntegrity сравнивает хеш скачанного файла с ожидаемым и записывает результат в статус ссылки.
+// Расхождение с ETag не считается ошибкой: ETag только похож на MD5 содержимого и не обязан им быть.
+func (j *linkJob) checkIntegrity(alg string, sum []byte) error {
+	result := &service.Integrity{
+		Status: service.IntegrityUnverified,
+		Actual: service.Checksum{Algorithm: alg, Sum: sum}.String(),
+	}
+
+	var err error
+	if want := j.expected(); want != nil {
+		result.Source = want.Source
+		result.Expected = want.String()
+		switch {
+		case want.Matches(sum):
+			result.Status = service.IntegrityVerified
+		case want.Source == service.ChecksumFromETag:
+			log.Printf("ETag of %s is not the MD5 of its content, integrity is unverified", j.url)
+		default:
+			result.Status = service.IntegrityMismatch
+			err = fmt.Errorf("%w: %s from %s, got %s", service.ErrIntegrity, result.Expected, result.Source, result.Actual)
+		}
+	}
+
+	j.update(func(l *service.Link) {
+		l.Integrity = result
+	})
+	return err
+}
+
+// verify считает хеш скачанного файла в рабочей директории и проверяет его целостность
+func verify(j *linkJob) error {
+	file, err := os.Open(filepath.Join(j.dir, storedName(j.idx)))
+	if err != nil {
+		return fmt.Errorf("failed to open downloaded file: %v", err)
+	}
+	defer file.Close()
+
+	h, alg := j.newHash()
+	if _, err := io.Copy(h, file); err != nil {
+		return fmt.Errorf("failed to read downloaded file: %v", err)
+	}
+	return j.checkIntegrity(alg, h.Sum(nil))
+}
+
+// discard удаляет скачанный файл вместе с чанками и журналом и возвращает его место в бюджет задачи,
+// чтобы файл можно было скачать заново с нуля
+func (j *linkJob) discard() {
+	os.Remove(filepath.Join(j.dir, storedName(j.idx)))
+
+	prefix := filepath.Join(j.dir, util.TMP_FILE_PREFIX+"-"+storedName(j.idx))
+	tmpFiles, _ := filepath.Glob(prefix + "-*.tmp")
+	for _, path := range append(tmpFiles, prefix+util.JOURNAL_FILE_SUFFIX) {
+		os.Remove(path)
+	}
+
+	if j.file != nil {
+		j.file.release()
+		j.file = nil
+	}
+	j.origin = nil
+}
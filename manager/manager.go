@@ -1,106 +1,542 @@
 package manager
 
 import (
+	"context"
+	"errors"
 	"fmt"
-	"github.com/vldmir/zip-service/service"
-	"github.com/vldmir/zip-service/util"
+	"io"
 	"log"
+	"mime"
+	"net/http"
 	"net/url"
+	"os"
+	"path/filepath"
 	"strconv"
+	"strings"
 	"sync"
 
 	"github.com/vldmir/zip-service/models"
+	"github.com/vldmir/zip-service/service"
+	"github.com/vldmir/zip-service/util"
 )
 
-func Run(urls []*url.URL, downloadDir string) {
-	// Инициализация HTTP клиента один раз для всех загрузок
-	client := service.NewHTTPClient()
+// linkJob - загрузка одной ссылки задачи в её рабочую директорию
+type linkJob struct {
+	client  *service.HTTPClient
+	storage *service.LinkService
+	taskID  string
+	idx     int
+	url     string
+	name    string // Имя файла, заданное пользователем
+	dir     string
 
-	for _, urlPtr := range urls {
-		urlStr := urlPtr.String()
-		log.Printf("\n=== Processing URL: %s ===\n", urlStr)
+	checksum string            // Ожидаемый хеш, заданный пользователем
+	origin   *service.Checksum // Ожидаемый хеш из заголовков ответа сервера
+
+	budget *budget     // Лимиты размера всей задачи
+	file   *fileBudget // Учет размера этого файла, появляется после проверки заявленного размера
+}
+
+// update изменяет запись о ссылке в storage
+func (j *linkJob) update(fn func(l *service.Link)) {
+	j.storage.UpdateLink(j.taskID, j.idx, fn)
+}
 
-		// make HEAD call
-		method := "HEAD"
-		headers := map[string]string{
-			"User-Agent": "CFD Downloader",
+// reserve проверяет заявленный размер файла по лимитам и резервирует его в бюджете задачи
+func (j *linkJob) reserve(declared int64) error {
+	file, err := j.budget.reserve(declared)
+	if err != nil {
+		return err
+	}
+	j.file = file
+	return nil
+}
+
+// resolveName выбирает имя файла в архиве: заданное пользователем, из Content-Disposition
+// ответа сервера или из пути ссылки. Имя из Content-Disposition с неразрешенным расширением игнорируется.
+func (j *linkJob) resolveName(contentDisposition string) string {
+	if j.name != "" {
+		return j.name
+	}
+
+	if _, params, err := mime.ParseMediaType(contentDisposition); err == nil {
+		name := util.SanitizeFileName(params["filename"])
+		if name != "" && j.storage.Types().CheckName(name) == nil {
+			return name
 		}
-		resp, err := client.Do(method, urlStr, headers)
-		if err != nil {
-			log.Printf("HEAD request failed for %s: %v", urlStr, err)
-			continue
+	}
+
+	if name, err := util.ExtractFileName(j.url); err == nil {
+		if name = util.SanitizeFileName(name); name != "" {
+			return name
 		}
+	}
+	return "file"
+}
 
-		// get Content-Length
-		contentLength := resp.Header.Get(util.CONTENT_LENGTH_HEADER)
-		contentLengthInBytes, err := strconv.Atoi(contentLength)
-		if err != nil {
-			log.Printf("Unsupported file download type for %s: %v", urlStr, err)
-			continue
+// fail помечает ссылку неудачной и возвращает место файла в бюджет задачи.
+// Файл не попадет в архив, поэтому имя записи архива у ссылки убирается.
+func (j *linkJob) fail(err error) {
+	if j.file != nil {
+		j.file.release()
+	}
+	j.update(func(l *service.Link) {
+		l.State = service.LinkFailed
+		l.Error = err.Error()
+		l.FileName = ""
+	})
+}
+
+// progress учитывает n скачанных байт в статусе ссылки и в лимитах размера
+func (j *linkJob) progress(n int) error {
+	j.update(func(l *service.Link) {
+		l.BytesDownloaded += int64(n)
+	})
+	if j.file == nil {
+		return nil
+	}
+	return j.file.add(n)
+}
+
+// Run скачивает все ссылки задачи в её рабочую директорию, до download.max_parallel_files одновременно,
+// отражая состояние каждой ссылки в storage. Отмена ctx прерывает загрузку.
+func Run(ctx context.Context, client *service.HTTPClient, storage *service.LinkService, task service.Task) error {
+	limits := storage.Config().Limits
+	taskBudget := newBudget(limits.MaxFileSizeMB, limits.MaxTaskSizeMB)
+
+	// Файлы, скачанные при предыдущем, прерванном запуске, попадут в архив,
+	// поэтому их место занимает бюджет задачи до загрузки остальных файлов
+	done := make(map[int]bool)
+	for idx, link := range task.Links {
+		if size, ok := downloaded(task.Dir, idx); ok && link.State == service.LinkDone {
+			taskBudget.charge(size)
+			done[idx] = true
 		}
-		log.Println("Content-Length:", contentLengthInBytes)
+	}
 
-		// get file name
-		fname, err := util.ExtractFileName(urlStr)
-		if err != nil {
-			log.Printf("Error extracting filename from %s: %v", urlStr, err)
+	jobs := make(chan *linkJob)
+	var wg sync.WaitGroup
+	for i := 0; i < storage.Config().Download.MaxParallelFiles; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for job := range jobs {
+				fetch(ctx, job)
+			}
+		}()
+	}
+
+feed:
+	for idx, link := range task.Links {
+		if done[idx] {
 			continue
 		}
-		log.Println("Filename extracted: ", fname)
 
-		// set concurrent workers
-		chunks := util.WORKER_ROUTINES
-		log.Printf("Set %v parallel workers/connections", chunks)
+		job := &linkJob{
+			client:  client,
+			storage: storage,
+			taskID:  task.ID,
+			idx:     idx,
+			url:     link.URL,
+			name:    link.Name,
+			dir:     task.Dir,
+			budget:  taskBudget,
+
+			checksum: link.Checksum,
+		}
+
+		select {
+		case jobs <- job:
+		case <-ctx.Done():
+			break feed
+		}
+	}
+	close(jobs)
+	wg.Wait()
 
-		// calculate chunk size
-		chunksize := contentLengthInBytes / chunks
-		log.Println("Each chunk size: ", chunksize)
+	return ctx.Err()
+}
 
-		// create the downloadRequest object
-		downReq := &models.DownloadRequest{
-			Url:         urlStr,
-			FileName:    fname,
-			Chunks:      chunks,
-			Chunksize:   chunksize,
-			TotalSize:   contentLengthInBytes,
-			HttpClient:  client,
-			DownloadDir: downloadDir, // Устанавливаем директорию загрузки
+// noFiles возвращает ошибку, если ни один файл задачи не скачан, с причинами отказа по ссылкам:
+// архив без файлов не нужен, и такая задача считается неудачной
+func noFiles(task service.Task) error {
+	var reasons []string
+	for _, link := range task.Links {
+		if link.State == service.LinkDone {
+			return nil
+		}
+		if link.Error != "" {
+			reasons = append(reasons, fmt.Sprintf("%s: %s", link.URL, link.Error))
 		}
+	}
+	if len(reasons) == 0 {
+		return fmt.Errorf("no files were downloaded")
+	}
+	return fmt.Errorf("no files were downloaded: %s", strings.Join(reasons, "; "))
+}
+
+// fetch скачивает одну ссылку задачи, проверяет её содержимое и целостность и отмечает результат в storage.
+// Файл, не прошедший проверку целостности, скачивается заново, пока не кончатся integrityAttempts.
+func fetch(ctx context.Context, job *linkJob) {
+	log.Printf("\n=== Processing URL: %s ===\n", job.url)
+
+	var err error
+	for attempt := 1; ; attempt++ {
+		err = download(ctx, job)
+		if err == nil {
+			err = checkContent(job)
+		}
+		if err == nil {
+			err = verify(job)
+		}
+		if !errors.Is(err, service.ErrIntegrity) || attempt >= integrityAttempts || ctx.Err() != nil {
+			break
+		}
+		log.Printf("%s failed integrity check: %v, downloading it again", job.url, err)
+		job.discard()
+	}
+	if err != nil && ctx.Err() != nil {
+		// Прерванная загрузка - не ошибка файла, он будет скачан при следующем запуске
+		job.update(func(l *service.Link) {
+			l.State = service.LinkPending
+		})
+		return
+	}
+	if err != nil {
+		log.Printf("Failed to download %s: %v", job.url, err)
+		job.fail(err)
+		return
+	}
+
+	job.update(func(l *service.Link) {
+		l.State = service.LinkDone
+	})
+}
+
+// storedName возвращает имя файла ссылки idx в рабочей директории задачи.
+// Файлы хранятся под номером ссылки, поэтому одинаковые имена из разных ссылок не пересекаются;
+// имя в архиве назначается при архивации.
+func storedName(idx int) string {
+	return fmt.Sprintf("link-%d", idx)
+}
+
+// downloaded сообщает, лежит ли уже файл ссылки в рабочей директории, и возвращает его размер
+func downloaded(dir string, idx int) (int64, bool) {
+	info, err := os.Stat(filepath.Join(dir, storedName(idx)))
+	if err != nil {
+		return 0, false
+	}
+	return info.Size(), true
+}
+
+// checkContent проверяет сигнатуру первых байт скачанного файла по списку разрешенных типов.
+// Файл неразрешенного типа удаляется из рабочей директории и не попадает в архив.
+func checkContent(j *linkJob) error {
+	filePath := filepath.Join(j.dir, storedName(j.idx))
+
+	file, err := os.Open(filePath)
+	if err != nil {
+		return fmt.Errorf("failed to open downloaded file: %v", err)
+	}
+	head := make([]byte, util.SNIFF_LEN)
+	n, err := io.ReadFull(file, head)
+	file.Close()
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return fmt.Errorf("failed to read downloaded file: %v", err)
+	}
+
+	// Тип, заявленный сервером, и имя файла записаны в ссылку при загрузке
+	var declared service.Link
+	if task, err := j.storage.GetTask(j.taskID); err == nil && j.idx < len(task.Links) {
+		declared = task.Links[j.idx]
+	}
+	mediaType, err := j.storage.Types().CheckContent(head[:n], j.url, declared.FileName, declared.ContentType)
+	j.update(func(l *service.Link) {
+		l.ContentType = mediaType
+	})
+	if err != nil {
+		os.Remove(filePath)
+		return err
+	}
+	return nil
+}
+
+// download скачивает одну ссылку параллельными чанками и склеивает их в итоговый файл.
+// Если сервер не поддерживает Range или не сообщает размер файла, файл скачивается одним потоком.
+func download(ctx context.Context, j *linkJob) error {
+	if _, err := url.Parse(j.url); err != nil {
+		return fmt.Errorf("invalid URL: %v", err)
+	}
+
+	j.update(func(l *service.Link) {
+		l.State = service.LinkDownloading
+	})
+
+	// create the downloadRequest object
+	downReq := &models.DownloadRequest{
+		Url:         j.url,
+		FileName:    storedName(j.idx),
+		HttpClient:  j.client,
+		DownloadDir: j.dir,
+		OnProgress:  j.progress,
+		Throttle:    j.storage.Throttle(),
+		TaskID:      j.taskID,
+	}
+
+	// make HEAD call
+	method := "HEAD"
+	headers := map[string]string{
+		"User-Agent": "CFD Downloader",
+	}
+	resp, err := j.client.Do(ctx, method, j.url, headers)
+	if err != nil {
+		return fmt.Errorf("HEAD request failed: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 300 {
+		j.setOrigin(resp.Header)
+	}
+
+	j.update(func(l *service.Link) {
+		l.HTTPStatus = resp.StatusCode
+		l.ContentType = resp.Header.Get("Content-Type")
+		l.FileName = j.resolveName(resp.Header.Get("Content-Disposition"))
+	})
+
+	// Некоторые серверы не поддерживают HEAD - тогда сразу скачиваем файл целиком
+	if resp.StatusCode == http.StatusMethodNotAllowed || resp.StatusCode == http.StatusNotImplemented {
+		log.Printf("HEAD is not supported by %s, falling back to a single stream", j.url)
+		return downloadSingle(ctx, j, downReq)
+	}
+	if resp.StatusCode > 299 {
+		return fmt.Errorf("origin responded with %s", resp.Status)
+	}
+
+	// Заявленный сервером тип проверяем до загрузки, чтобы не качать заведомо лишнее
+	if err := j.storage.Types().CheckContentType(resp.Header.Get("Content-Type")); err != nil {
+		return err
+	}
+
+	// get Content-Length
+	contentLength := resp.Header.Get(util.CONTENT_LENGTH_HEADER)
+	contentLengthInBytes, err := strconv.Atoi(contentLength)
+	if err != nil || contentLengthInBytes <= 0 {
+		log.Printf("Unknown Content-Length for %s, falling back to a single stream", j.url)
+		return downloadSingle(ctx, j, downReq)
+	}
+	log.Println("Content-Length:", contentLengthInBytes)
+	j.update(func(l *service.Link) {
+		l.ContentLength = int64(contentLengthInBytes)
+	})
+
+	// Слишком большой файл отклоняем до загрузки
+	if err := j.reserve(int64(contentLengthInBytes)); err != nil {
+		return err
+	}
+
+	if !strings.EqualFold(resp.Header.Get(util.ACCEPT_RANGES_HEADER), "bytes") {
+		log.Printf("Range requests are not supported by %s, falling back to a single stream", j.url)
+		return downloadSingle(ctx, j, downReq)
+	}
+
+	downReq.TotalSize = contentLengthInBytes
+	downReq.ETag = resp.Header.Get("ETag")
+	downReq.LastModified = resp.Header.Get("Last-Modified")
+
+	// Число чанков зависит от размера файла; маленький файл скачиваем одним запросом.
+	// Файл занимает не больше соединений, чем лимит на хост, и не больше своей доли общего лимита,
+	// чтобы соединений хватало всем одновременно скачиваемым файлам задачи;
+	// downloadChunks держит эту долю, даже если чанков больше.
+	cfg := j.storage.Config().Download
+	downReq.MinChunkSize = cfg.MinChunkSizeKB << 10
+	downReq.MaxChunkSize = cfg.MaxChunkSizeMB << 20
+	downReq.MaxConnections = cfg.MaxConnectionsPerHost
+	if cfg.MaxConnections > 0 {
+		downReq.MaxConnections = min(downReq.MaxConnections, max(cfg.MaxConnections/cfg.MaxParallelFiles, 1))
+	}
+	downReq.SplitIntoChunks()
+	if downReq.Chunks == 1 {
+		log.Printf("File %s is smaller than two chunks, downloading it in a single request", j.url)
+		return downloadSingle(ctx, j, downReq)
+	}
+	log.Printf("Downloading %s in %v chunks of %v bytes over up to %v connections",
+		j.url, downReq.Chunks, downReq.Chunksize, downReq.MaxConnections)
+
+	err = downloadChunks(ctx, j, downReq)
+	if errors.Is(err, models.ErrOriginChanged) {
+		// Файл на сервере изменился во время загрузки - начинаем его заново один раз
+		log.Printf("Origin %s changed during download, restarting it", j.url)
+		err = downloadChunks(ctx, j, downReq)
+	}
+	if errors.Is(err, models.ErrRangeNotSupported) {
+		// Сервер заявил поддержку Range, но вернул файл целиком
+		log.Printf("Origin %s ignored Range header, falling back to a single stream", j.url)
+		return downloadSingle(ctx, j, downReq)
+	}
+	return err
+}
+
+// downloadChunks скачивает файл параллельными чанками и склеивает их в итоговый файл.
+// Прогресс чанков записывается в журнал: упавшие чанки докачиваются с места остановки
+// как повторными попытками в этом запуске, так и при следующем запуске задачи.
+func downloadChunks(ctx context.Context, j *linkJob, downReq *models.DownloadRequest) error {
+	planned := downReq.SplitIntoChunks()
+	journal, ok := downReq.LoadJournal()
+	if ok {
+		log.Printf("Resuming %s from journal", downReq.FileName)
+		downReq.Chunks = len(journal.Chunks)
+	} else {
+		// Журнал отсутствует или относится к другой версии файла - начинаем с нуля,
+		// удалив чанки, скачанные по старому плану
+		if journal != nil {
+			downReq.Chunks = len(journal.Chunks)
+			downReq.CleanupTmpFiles()
+		}
+		downReq.Chunks = len(planned)
+		downReq.CleanupTmpFiles()
 
 		// chunk it up
-		byteRangeArray := make([][2]int, chunks)
-		byteRangeArray = downReq.SplitIntoChunks()
-		fmt.Println(byteRangeArray)
+		journal = downReq.NewJournal(planned)
+		if err := journal.Save(); err != nil {
+			return err
+		}
+	}
+	byteRangeArray := journal.Chunks
+	fmt.Println(byteRangeArray)
+
+	// Уже скачанные ранее байты учитываем в прогрессе ссылки и в лимитах размера
+	resumed := downReq.DownloadedBytes()
+	if j.file != nil {
+		j.file.reset()
+		if err := j.file.add(int(resumed)); err != nil {
+			return err
+		}
+	}
+	j.update(func(l *service.Link) {
+		l.BytesDownloaded = resumed
+	})
 
-		// download each chunk concurrently
+	// Одновременно качается не больше MaxConnections чанков файла - его доли соединений,
+	// даже если max_chunk_size_mb потребовал больше чанков; места среди всех задач выдает планировщик клиента
+	connections := downReq.MaxConnections
+	if connections < 1 {
+		connections = 1
+	}
+	sem := make(chan struct{}, connections)
+
+	for attempt := 1; ; attempt++ {
+		// download each pending chunk concurrently
 		var wg sync.WaitGroup
-		for idx, byteChunk := range byteRangeArray {
+		errs := make([]error, len(byteRangeArray))
+		for i, byteChunk := range byteRangeArray {
+			if journal.Done[i] {
+				continue
+			}
 			wg.Add(1)
 
-			go func(idx int, byteChunk [2]int) {
+			go func(i int, byteChunk [2]int) {
 				defer wg.Done()
-				err := downReq.Download(idx, byteChunk)
-				if err != nil {
-					log.Printf("Failed to download chunk %v from %s: %v", idx, urlStr, err)
+				sem <- struct{}{}
+				defer func() { <-sem }()
+				errs[i] = downReq.Download(ctx, i, byteChunk)
+				if errs[i] == nil {
+					if err := journal.MarkDone(i); err != nil {
+						log.Printf("Failed to update journal of %s: %v", downReq.FileName, err)
+					}
 				}
-			}(idx, byteChunk)
+			}(i, byteChunk)
 		}
 		wg.Wait()
 
-		// merge
-		err = downReq.MergeDownloads()
-		if err != nil {
-			log.Printf("Failed merging tmp downloaded files for %s: %v", urlStr, err)
-			continue
+		var failed error
+		for i, err := range errs {
+			if err == nil {
+				continue
+			}
+			// Сервер не поддерживает Range или файл изменился - докачка невозможна
+			if errors.Is(err, models.ErrRangeNotSupported) || errors.Is(err, models.ErrOriginChanged) {
+				downReq.CleanupTmpFiles()
+				return err
+			}
+			if failed == nil {
+				failed = fmt.Errorf("failed to download chunk %v: %v", i, err)
+			}
+		}
+		if failed == nil {
+			break
 		}
 
-		// cleanup
-		err = downReq.CleanupTmpFiles()
-		if err != nil {
-			log.Printf("Failed cleaning up tmp downloaded files for %s: %v", urlStr, err)
+		// При отмене или исчерпании попыток временные файлы и журнал остаются для докачки
+		if ctx.Err() != nil {
+			return ctx.Err()
 		}
+		if attempt >= j.client.MaxAttempts() {
+			return failed
+		}
+		delay := j.client.Backoff(attempt)
+		log.Printf("Attempt %d for %s failed: %v, resuming failed chunks in %v", attempt, downReq.FileName, failed, delay)
+		if err := service.Sleep(ctx, delay); err != nil {
+			return err
+		}
+	}
 
-		// final file generated
-		log.Printf("File successfully downloaded: %v\n", downReq.FileName)
+	// merge
+	err := downReq.MergeDownloads(ctx)
+	if err != nil {
+		return fmt.Errorf("failed merging tmp downloaded files: %w", err)
 	}
+
+	// cleanup
+	err = downReq.CleanupTmpFiles()
+	if err != nil {
+		log.Printf("Failed cleaning up tmp downloaded files for %s: %v", downReq.Url, err)
+	}
+
+	// final file generated
+	log.Printf("File successfully downloaded: %v\n", downReq.FileName)
+	return nil
+}
+
+// downloadSingle скачивает файл одним GET-запросом без Range.
+// Размер файла может быть неизвестен заранее (chunked transfer encoding):
+// тогда лимиты размера проверяются по мере загрузки.
+func downloadSingle(ctx context.Context, j *linkJob, downReq *models.DownloadRequest) error {
+	if j.file == nil {
+		if err := j.reserve(0); err != nil {
+			return err
+		}
+	}
+	j.file.reset()
+	j.update(func(l *service.Link) {
+		l.BytesDownloaded = 0
+	})
+
+	resp, err := downReq.DownloadSingle(ctx)
+	if resp != nil {
+		j.update(func(l *service.Link) {
+			l.HTTPStatus = resp.StatusCode
+			l.ContentType = resp.Header.Get("Content-Type")
+			if resp.ContentLength > 0 {
+				l.ContentLength = resp.ContentLength
+			}
+			if cd := resp.Header.Get("Content-Disposition"); cd != "" || l.FileName == "" {
+				l.FileName = j.resolveName(cd)
+			}
+		})
+	}
+	if err != nil {
+		return err
+	}
+	// Заголовки распакованного транспортом ответа описывают сжатое тело, а не файл
+	if !resp.Uncompressed {
+		j.setOrigin(resp.Header)
+	}
+
+	if err := j.storage.Types().CheckContentType(resp.Header.Get("Content-Type")); err != nil {
+		os.Remove(filepath.Join(downReq.DownloadDir, downReq.FileName))
+		return err
+	}
+
+	log.Printf("File successfully downloaded: %v\n", downReq.FileName)
+	return nil
 }
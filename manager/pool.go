@@ -0,0 +1,291 @@
+package manager
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/vldmir/zip-service/service"
+)
+
+// Pool - ограниченный пул фоновых воркеров, выполняющих задачи на загрузку и архивацию
+type Pool struct {
+	storage *service.LinkService
+	client  *service.HTTPClient // Общий HTTP клиент с политикой повторов для всех загрузок
+	queue   chan string
+
+	mu      sync.Mutex
+	running map[string]*run // Выполняющиеся сейчас задачи
+	closed  bool            // Пул остановлен и не принимает новых задач
+}
+
+// run - выполняющаяся задача, которую можно отменить
+type run struct {
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+// stopGrace - сколько ждать остановки отмененной задачи
+const stopGrace = 5 * time.Second
+
+// stop отменяет задачу и ждет её остановки не дольше stopGrace.
+// Задача, застрявшая в записи ответа клиенту, может не заметить отмену, и ждать её бесконечно нельзя.
+func (r *run) stop() bool {
+	r.cancel()
+
+	timer := time.NewTimer(stopGrace)
+	defer timer.Stop()
+	select {
+	case <-r.done:
+		return true
+	case <-timer.C:
+		return false
+	}
+}
+
+// NewPool создает пул и запускает workers воркеров
+func NewPool(storage *service.LinkService, client *service.HTTPClient, workers int) *Pool {
+	if workers < 1 {
+		workers = 1
+	}
+
+	p := &Pool{
+		storage: storage,
+		client:  client,
+		queue:   make(chan string, workers),
+		running: make(map[string]*run),
+	}
+
+	for i := 0; i < workers; i++ {
+		go p.worker(i)
+	}
+
+	return p
+}
+
+// Submit ставит задачу в очередь на выполнение
+func (p *Pool) Submit(taskID string) error {
+	if p.Closed() {
+		return service.ErrShuttingDown
+	}
+	prev, err := p.storage.QueueTask(taskID)
+	if err != nil {
+		return err
+	}
+
+	select {
+	case p.queue <- taskID:
+		log.Printf("Task %s queued", taskID)
+		return nil
+	default:
+		// Очередь заполнена - возвращаем задаче прежнее состояние: незапущенной, прерванной или выполненной
+		p.storage.UnqueueTask(prev)
+		return fmt.Errorf("%w: task queue is full, try again later", service.ErrServerBusy)
+	}
+}
+
+// RunNow выполняет задачу синхронно в текущей горутине, минуя очередь.
+// ctx привязан к запросу клиента: если клиент отключился, загрузка и архивация
+// прерываются, а задача помечается прерванной и может быть продолжена позже.
+// Такую задачу так же можно отменить через Cancel.
+func (p *Pool) RunNow(ctx context.Context, taskID string) error {
+	return p.runNow(ctx, taskID, func(ctx context.Context) error {
+		return Process(ctx, p.client, p.storage, taskID)
+	})
+}
+
+// StreamNow синхронно скачивает файлы задачи и сразу пишет их в ZIP-архив в w,
+// не сохраняя файлы на диск. Отключение клиента прерывает задачу так же, как в RunNow.
+func (p *Pool) StreamNow(ctx context.Context, taskID string, w io.Writer, opts StreamOptions) error {
+	return p.runNow(ctx, taskID, func(ctx context.Context) error {
+		return Stream(ctx, p.client, p.storage, taskID, w, opts)
+	})
+}
+
+func (p *Pool) runNow(ctx context.Context, taskID string, fn func(ctx context.Context) error) error {
+	if p.Closed() {
+		return service.ErrShuttingDown
+	}
+	if _, err := p.storage.QueueTask(taskID); err != nil {
+		return err
+	}
+
+	err := p.execute(ctx, taskID, fn)
+	if ctx.Err() != nil {
+		p.storage.AbortTask(taskID, "aborted by client")
+	}
+	return err
+}
+
+// Cancel помечает задачу отмененной и, если она выполняется,
+// прерывает её загрузки и дожидается остановки
+func (p *Pool) Cancel(taskID string) error {
+	err := p.storage.SetStatus(taskID, service.StatusCancelled)
+
+	p.mu.Lock()
+	r := p.running[taskID]
+	p.mu.Unlock()
+
+	if r != nil && !r.stop() {
+		log.Printf("Task %s did not stop within %v after cancellation", taskID, stopGrace)
+	}
+
+	return err
+}
+
+// Closed сообщает, остановлен ли пул
+func (p *Pool) Closed() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.closed
+}
+
+// Shutdown перестает принимать задачи и ждет завершения выполняющихся, пока не отменен ctx.
+// Оставшиеся после этого задачи прерываются и вместе с задачами из очереди помечаются прерванными,
+// чтобы их можно было продолжить после перезапуска.
+func (p *Pool) Shutdown(ctx context.Context) error {
+	p.mu.Lock()
+	p.closed = true
+	runs := make(map[string]*run, len(p.running))
+	for taskID, r := range p.running {
+		runs[taskID] = r
+	}
+	p.mu.Unlock()
+
+	var err error
+	interrupted := make(map[string]*run)
+	for taskID, r := range runs {
+		select {
+		case <-r.done:
+			continue
+		case <-ctx.Done():
+			err = ctx.Err()
+		}
+		log.Printf("Interrupting task %s", taskID)
+		r.cancel()
+		interrupted[taskID] = r
+	}
+
+	// Все прерванные задачи делят одно ожидание stopGrace
+	grace := time.NewTimer(stopGrace)
+	defer grace.Stop()
+	for taskID, r := range interrupted {
+		select {
+		case <-r.done:
+		case <-grace.C:
+			log.Printf("Task %s did not stop within %v, leaving it behind", taskID, stopGrace)
+			grace.Reset(0)
+		}
+		p.storage.AbortTask(taskID, service.AbortedByShutdown)
+	}
+
+	for {
+		select {
+		case taskID := <-p.queue:
+			p.storage.AbortTask(taskID, service.AbortedByShutdown)
+		default:
+			return err
+		}
+	}
+}
+
+func (p *Pool) worker(id int) {
+	for taskID := range p.queue {
+		if p.Closed() {
+			p.storage.AbortTask(taskID, service.AbortedByShutdown)
+			continue
+		}
+		log.Printf("Worker %d picked up task %s", id, taskID)
+		err := p.execute(context.Background(), taskID, func(ctx context.Context) error {
+			return Process(ctx, p.client, p.storage, taskID)
+		})
+		if err != nil {
+			log.Printf("Task %s failed: %v", taskID, err)
+		}
+	}
+}
+
+// execute регистрирует задачу как выполняющуюся и обрабатывает её функцией fn
+func (p *Pool) execute(ctx context.Context, taskID string, fn func(ctx context.Context) error) error {
+	ctx, cancel := context.WithCancel(ctx)
+	r := &run{cancel: cancel, done: make(chan struct{})}
+
+	p.mu.Lock()
+	if p.closed {
+		// Пул остановился, пока задача ждала запуска
+		p.mu.Unlock()
+		cancel()
+		p.storage.AbortTask(taskID, service.AbortedByShutdown)
+		return service.ErrShuttingDown
+	}
+	p.running[taskID] = r
+	p.mu.Unlock()
+
+	defer func() {
+		cancel()
+		p.mu.Lock()
+		delete(p.running, taskID)
+		p.mu.Unlock()
+		close(r.done)
+	}()
+
+	// Запросы задачи к источникам делят соединения с другими задачами по очереди
+	return fn(service.WithTask(ctx, taskID))
+}
+
+// Process скачивает файлы поставленной в очередь задачи и собирает архив на диске,
+// проводя задачу через состояния downloading -> archiving -> completed (или failed)
+func Process(ctx context.Context, client *service.HTTPClient, storage *service.LinkService, taskID string) error {
+	if err := storage.SetStatus(taskID, service.StatusDownloading); err != nil {
+		return err
+	}
+	if err := storage.ResetLinks(taskID); err != nil {
+		return err
+	}
+
+	task, err := storage.GetTask(taskID)
+	if err != nil {
+		return err
+	}
+
+	// Загружаем файлы. При отмене ctx состояние задачи выставляет тот, кто её отменил.
+	if err := Run(ctx, client, storage, task); err != nil {
+		if ctx.Err() == nil {
+			storage.FailTask(taskID, err)
+		}
+		return err
+	}
+
+	if task, err = storage.GetTask(taskID); err != nil {
+		return err
+	}
+	if err := noFiles(task); err != nil {
+		storage.FailTask(taskID, err)
+		return err
+	}
+
+	if err := storage.SetStatus(taskID, service.StatusArchiving); err != nil {
+		return err
+	}
+	names := EntryNames(task.Links)
+	for idx, name := range names {
+		if name != "" {
+			storage.UpdateLink(taskID, idx, func(l *service.Link) {
+				l.FileName = name
+			})
+		}
+	}
+
+	archivePath, err := BuildArchive(ctx, task.Dir, names)
+	if err != nil {
+		if ctx.Err() == nil {
+			storage.FailTask(taskID, err)
+		}
+		return err
+	}
+
+	return storage.CompleteTask(taskID, archivePath)
+}
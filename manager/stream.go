@@ -0,0 +1,345 @@
+package manager
+
+import (
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"time"
+
+	"github.com/vldmir/zip-service/service"
+	"github.com/vldmir/zip-service/util"
+)
+
+// StreamOptions настраивает потоковую архивацию без сохранения файлов на диск
+type StreamOptions struct {
+	ReadAhead       bool  // Скачивать следующий файл, пока текущий пишется в архив
+	ReadAheadMemory int64 // Сколько байт следующего файла держать в памяти, остальное уходит во временный файл
+}
+
+// source - открытый источник файла для записи в архив
+type source struct {
+	job   *linkJob
+	name  string
+	r     io.Reader
+	close func()
+	err   error
+}
+
+// Stream скачивает файлы задачи и сразу пишет их в ZIP-архив в w,
+// проводя задачу через состояния downloading -> archiving -> completed (или failed).
+// Архив не сохраняется на диск, поэтому у выполненной задачи нет ArchivePath.
+func Stream(ctx context.Context, client *service.HTTPClient, storage *service.LinkService, taskID string, w io.Writer, opts StreamOptions) error {
+	if err := storage.SetStatus(taskID, service.StatusDownloading); err != nil {
+		return err
+	}
+	if err := storage.ResetLinks(taskID); err != nil {
+		return err
+	}
+
+	task, err := storage.GetTask(taskID)
+	if err != nil {
+		return err
+	}
+
+	if err := StreamArchive(ctx, w, client, storage, task, opts); err != nil {
+		if ctx.Err() == nil {
+			storage.FailTask(taskID, err)
+		}
+		return err
+	}
+
+	// Пустой архив уже отправлен клиенту, но задача без единого файла считается неудачной
+	if task, err = storage.GetTask(taskID); err != nil {
+		return err
+	}
+	if err := noFiles(task); err != nil {
+		storage.FailTask(taskID, err)
+		return err
+	}
+
+	if err := storage.SetStatus(taskID, service.StatusArchiving); err != nil {
+		return err
+	}
+	return storage.CompleteTask(taskID, "")
+}
+
+// StreamArchive последовательно пишет тело каждой ссылки задачи в отдельную запись ZIP-архива.
+// Файлы, которые не удалось открыть, пропускаются и помечаются failed.
+// С ReadAhead следующий файл скачивается в фоне, пока текущий пишется в архив.
+func StreamArchive(ctx context.Context, w io.Writer, client *service.HTTPClient, storage *service.LinkService, task service.Task, opts StreamOptions) error {
+	zipWriter := zip.NewWriter(w)
+
+	limits := storage.Config().Limits
+	taskBudget := newBudget(limits.MaxFileSizeMB, limits.MaxTaskSizeMB)
+	newJob := func(idx int) *linkJob {
+		return &linkJob{
+			client:  client,
+			storage: storage,
+			taskID:  task.ID,
+			idx:     idx,
+			url:     task.Links[idx].URL,
+			name:    task.Links[idx].Name,
+			dir:     task.Dir,
+			budget:  taskBudget,
+
+			checksum: task.Links[idx].Checksum,
+		}
+	}
+
+	// Имена записей назначаются в порядке ссылок так же, как при архивации на диске
+	used := make(map[string]bool)
+
+	ctx, cancel := context.WithCancel(ctx)
+	var next <-chan *source
+	defer func() {
+		// Останавливаем и освобождаем скачиваемый наперед файл, если архивация прервалась
+		cancel()
+		if next != nil {
+			if src := <-next; src.close != nil {
+				src.close()
+			}
+		}
+	}()
+
+	for idx := range task.Links {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		var src *source
+		if next != nil {
+			src = <-next
+			next = nil
+		} else {
+			src = openSource(ctx, newJob(idx))
+		}
+
+		if opts.ReadAhead && idx+1 < len(task.Links) {
+			ch := make(chan *source, 1)
+			go func(j *linkJob) {
+				ch <- prefetchSource(ctx, j, opts.ReadAheadMemory)
+			}(newJob(idx + 1))
+			next = ch
+		}
+
+		if src.err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			log.Printf("Skipping %s: %v", task.Links[idx].URL, src.err)
+			src.job.fail(src.err)
+			continue
+		}
+
+		src.name = util.UniqueName(src.name, used)
+		err := writeEntry(zipWriter, src)
+		src.close()
+		if err != nil {
+			// Наполовину записанную запись из архива не убрать - прерываем весь архив
+			src.job.fail(err)
+			return fmt.Errorf("failed to stream %s: %v", task.Links[idx].URL, err)
+		}
+
+		src.job.update(func(l *service.Link) {
+			l.State = service.LinkDone
+			l.FileName = src.name
+		})
+	}
+
+	return zipWriter.Close()
+}
+
+// writeEntry создает запись архива, копирует в неё содержимое источника и проверяет его целостность.
+// Запись с неверным хешем уже попала в архив, поэтому ошибка целостности прерывает весь архив.
+func writeEntry(zipWriter *zip.Writer, src *source) error {
+	header := &zip.FileHeader{
+		Name:     src.name,
+		Method:   zip.Deflate,
+		Modified: time.Now(),
+		Flags:    zipFlagUTF8,
+	}
+
+	writer, err := zipWriter.CreateHeader(header)
+	if err != nil {
+		return fmt.Errorf("failed to create zip entry %s: %v", src.name, err)
+	}
+
+	h, alg := src.job.newHash()
+	if _, err := io.Copy(writer, io.TeeReader(src.r, h)); err != nil {
+		return err
+	}
+	return src.job.checkIntegrity(alg, h.Sum(nil))
+}
+
+// openSource выполняет GET для ссылки и возвращает её тело для чтения напрямую
+func openSource(ctx context.Context, j *linkJob) *source {
+	j.update(func(l *service.Link) {
+		l.State = service.LinkDownloading
+		l.BytesDownloaded = 0
+	})
+
+	headers := map[string]string{
+		"User-Agent": "CFD Downloader",
+	}
+	resp, err := j.client.Do(ctx, "GET", j.url, headers)
+	if err != nil {
+		return &source{job: j, err: fmt.Errorf("request failed: %v", err)}
+	}
+
+	name := j.resolveName(resp.Header.Get("Content-Disposition"))
+	j.update(func(l *service.Link) {
+		l.HTTPStatus = resp.StatusCode
+		l.ContentType = resp.Header.Get("Content-Type")
+		l.FileName = name
+		if resp.ContentLength > 0 {
+			l.ContentLength = resp.ContentLength
+		}
+	})
+	if resp.StatusCode > 299 {
+		resp.Body.Close()
+		return &source{job: j, err: fmt.Errorf("origin responded with %s", resp.Status)}
+	}
+	// Заголовки распакованного транспортом ответа описывают сжатое тело, а не файл
+	if !resp.Uncompressed {
+		j.setOrigin(resp.Header)
+	}
+
+	if err := j.storage.Types().CheckContentType(resp.Header.Get("Content-Type")); err != nil {
+		resp.Body.Close()
+		return &source{job: j, err: err}
+	}
+
+	// Слишком большой файл отклоняем до создания записи архива;
+	// сервер, занизивший или не сообщивший размер, остановит проверка при чтении
+	if err := j.reserve(resp.ContentLength); err != nil {
+		resp.Body.Close()
+		return &source{job: j, err: err}
+	}
+
+	// Общий лимит скорости и лимит задачи действуют на отдачу архива клиенту, здесь - только лимит хоста
+	src, release := j.storage.Throttle().SourceReader(ctx, j.url, resp.Body)
+	closeBody := func() {
+		resp.Body.Close()
+		release()
+	}
+	body := bufio.NewReaderSize(&progressReader{r: src, onProgress: j.progress}, util.SNIFF_LEN)
+
+	// Тип по сигнатуре определяем до создания записи архива, чтобы не пришлось её отменять
+	head, err := body.Peek(util.SNIFF_LEN)
+	if err != nil && err != io.EOF {
+		closeBody()
+		return &source{job: j, err: fmt.Errorf("failed to read response: %v", err)}
+	}
+	mediaType, err := j.storage.Types().CheckContent(head, j.url, name, resp.Header.Get("Content-Type"))
+	j.update(func(l *service.Link) {
+		l.ContentType = mediaType
+	})
+	if err != nil {
+		closeBody()
+		return &source{job: j, err: err}
+	}
+
+	return &source{
+		job:   j,
+		name:  name,
+		r:     body,
+		close: closeBody,
+	}
+}
+
+// prefetchSource скачивает ссылку целиком заранее: первые memLimit байт в память,
+// остальное во временный файл рабочей директории задачи
+func prefetchSource(ctx context.Context, j *linkJob, memLimit int64) *source {
+	src := openSource(ctx, j)
+	if src.err != nil {
+		return src
+	}
+	defer src.close()
+
+	buf := &spool{dir: j.dir, limit: memLimit}
+	if _, err := io.Copy(buf, src.r); err != nil {
+		buf.Close()
+		return &source{job: j, err: fmt.Errorf("read-ahead failed: %v", err)}
+	}
+
+	r, err := buf.Reader()
+	if err != nil {
+		buf.Close()
+		return &source{job: j, err: err}
+	}
+
+	return &source{
+		job:   j,
+		name:  src.name,
+		r:     r,
+		close: buf.Close,
+	}
+}
+
+// progressReader сообщает о каждой прочитанной порции байт; ошибка onProgress прерывает чтение
+type progressReader struct {
+	r          io.Reader
+	onProgress func(n int) error
+}
+
+func (p *progressReader) Read(b []byte) (int, error) {
+	n, err := p.r.Read(b)
+	if n > 0 && p.onProgress != nil {
+		if perr := p.onProgress(n); perr != nil {
+			return n, perr
+		}
+	}
+	return n, err
+}
+
+// spool - буфер заранее скачанного файла: до limit байт в памяти, остальное во временном файле
+type spool struct {
+	dir   string
+	limit int64
+	mem   bytes.Buffer
+	file  *os.File
+}
+
+func (s *spool) Write(p []byte) (int, error) {
+	if s.file == nil {
+		if room := s.limit - int64(s.mem.Len()); room > 0 {
+			if int64(len(p)) <= room {
+				return s.mem.Write(p)
+			}
+			s.mem.Write(p[:room])
+			n, err := s.Write(p[room:])
+			return int(room) + n, err
+		}
+
+		file, err := os.CreateTemp(s.dir, util.TMP_FILE_PREFIX+"-stream-*.tmp")
+		if err != nil {
+			return 0, fmt.Errorf("failed to create read-ahead file: %v", err)
+		}
+		s.file = file
+	}
+	return s.file.Write(p)
+}
+
+// Reader возвращает содержимое буфера для чтения с начала
+func (s *spool) Reader() (io.Reader, error) {
+	if s.file == nil {
+		return &s.mem, nil
+	}
+	if _, err := s.file.Seek(0, io.SeekStart); err != nil {
+		return nil, fmt.Errorf("failed to rewind read-ahead file: %v", err)
+	}
+	return io.MultiReader(&s.mem, s.file), nil
+}
+
+// Close удаляет временный файл буфера
+func (s *spool) Close() {
+	if s.file != nil {
+		s.file.Close()
+		os.Remove(s.file.Name())
+	}
+}
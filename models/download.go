@@ -1,110 +1,321 @@
 package models
 
 import (
+	"context"
+	"errors"
 	"fmt"
-	"github.com/vldmir/zip-service/service"
 	"io"
 	"log"
+	"net/http"
 	"os"
+	"path/filepath"
+	"strings"
 
+	"github.com/vldmir/zip-service/service"
 	"github.com/vldmir/zip-service/util"
 )
 
+// ErrRangeNotSupported возвращается, если сервер проигнорировал заголовок Range и отдал файл целиком
+var ErrRangeNotSupported = errors.New("origin ignored Range header")
+
+// ErrOriginChanged возвращается, если файл на сервере изменился с начала загрузки
+// и докачать чанк с места остановки нельзя
+var ErrOriginChanged = errors.New("origin file changed since download started")
+
 type DownloadRequest struct {
-	Url         string 
+	Url         string
 	FileName    string
 	Chunks      int
 	Chunksize   int
 	TotalSize   int
 	HttpClient  *service.HTTPClient
-	DownloadDir string // Добавляем поле для директории загрузки
+	DownloadDir string            // Рабочая директория задачи, в которую идет загрузка
+	OnProgress  func(n int) error // Вызывается после записи каждой порции байт; ошибка прерывает загрузку
+
+	// Валидаторы версии файла из ответа на HEAD, используются в If-Range при докачке
+	ETag         string
+	LastModified string
+
+	// Ограничения плана загрузки по чанкам, в байтах; 0 - без ограничения
+	MinChunkSize   int
+	MaxChunkSize   int
+	MaxConnections int // Сколько чанков файла скачивается одновременно
+
+	// Ограничение скорости загрузки; nil - без ограничения
+	Throttle *service.Throttle
+	TaskID   string
+}
+
+// progressWriter сообщает о каждой записанной порции байт
+type progressWriter struct {
+	w          io.Writer
+	onProgress func(n int) error
+}
+
+func (p *progressWriter) Write(b []byte) (int, error) {
+	n, err := p.w.Write(b)
+	if n > 0 && p.onProgress != nil {
+		if perr := p.onProgress(n); perr != nil {
+			return n, perr
+		}
+	}
+	return n, err
+}
+
+// tmpFilePath возвращает путь к временному файлу чанка внутри рабочей директории.
+// Имя файла входит в путь, чтобы чанки разных файлов задачи не пересекались.
+func (d *DownloadRequest) tmpFilePath(idx int) string {
+	return filepath.Join(d.DownloadDir, fmt.Sprintf("%s-%s-%v.tmp", util.TMP_FILE_PREFIX, d.FileName, idx))
 }
 
+// SplitIntoChunks планирует загрузку файла размером TotalSize по чанкам и возвращает их диапазоны байт.
+// Чанков столько, сколько позволяет MaxConnections, но каждый не меньше MinChunkSize;
+// если при этом чанк выходит больше MaxChunkSize, чанков становится больше, чем соединений.
+// Размеры чанков отличаются не больше чем на байт, пустых чанков не бывает.
+// Выбранное число чанков и их размер записываются в Chunks и Chunksize.
 func (d *DownloadRequest) SplitIntoChunks() [][2]int {
-	arr := make([][2]int, d.Chunks)
-	for i := 0; i < d.Chunks; i++ {
-		if i == 0 {
-			arr[i][0] = 0
-			arr[i][1] = d.Chunksize
-		} else if i == d.Chunks-1 {
-			arr[i][0] = arr[i-1][1] + 1
-			arr[i][1] = d.TotalSize - 1
-		} else {
-			arr[i][0] = arr[i-1][1] + 1
-			arr[i][1] = arr[i][0] + d.Chunksize
+	chunks := d.MaxConnections
+	if chunks < 1 {
+		chunks = 1
+	}
+	if d.MinChunkSize > 0 && d.TotalSize/d.MinChunkSize < chunks {
+		chunks = d.TotalSize / d.MinChunkSize
+	}
+	if d.MaxChunkSize > 0 {
+		if n := (d.TotalSize + d.MaxChunkSize - 1) / d.MaxChunkSize; n > chunks {
+			chunks = n
 		}
 	}
+	if chunks > d.TotalSize {
+		chunks = d.TotalSize
+	}
+	if chunks < 1 {
+		chunks = 1
+	}
+
+	d.Chunks = chunks
+	d.Chunksize = d.TotalSize / chunks
+
+	// Остаток от деления распределяем по одному байту на первые чанки
+	arr := make([][2]int, chunks)
+	start := 0
+	for i := range arr {
+		size := d.Chunksize
+		if i < d.TotalSize%chunks {
+			size++
+		}
+		arr[i][0] = start
+		arr[i][1] = start + size - 1
+		start += size
+	}
 
 	return arr
 }
 
-func (d *DownloadRequest) Download(idx int, byteChunk [2]int) error {
-	log.Println(fmt.Sprintf("Downloading chunk %v", idx))
+// Download скачивает чанк idx во временный файл.
+// Если временный файл уже содержит часть чанка, загрузка продолжается с места остановки.
+func (d *DownloadRequest) Download(ctx context.Context, idx int, byteChunk [2]int) error {
+	tmpFilePath := d.tmpFilePath(idx)
+	expected := int64(byteChunk[1] - byteChunk[0] + 1)
+
+	// Уже скачанная часть чанка
+	var offset int64
+	if info, err := os.Stat(tmpFilePath); err == nil {
+		offset = info.Size()
+	}
+	if offset > expected {
+		offset = 0
+	}
+	if offset == expected {
+		log.Println(fmt.Sprintf("Chunk %v is already downloaded", idx))
+		return nil
+	}
+
+	log.Println(fmt.Sprintf("Downloading chunk %v from offset %v", idx, offset))
 	// make GET request with range
 	method := "GET"
 	headers := map[string]string{
 		"User-Agent": "CFD Downloader",
-		"Range":      fmt.Sprintf("bytes=%v-%v", byteChunk[0], byteChunk[1]),
+		"Range":      fmt.Sprintf("bytes=%v-%v", int64(byteChunk[0])+offset, byteChunk[1]),
 	}
-	resp, err := d.HttpClient.Do(method, d.Url, headers)
+	// If-Range гарантирует, что докачиваемая часть относится к той же версии файла
+	if validator := d.ifRange(); offset > 0 && validator != "" {
+		headers["If-Range"] = validator
+	}
+	resp, err := d.HttpClient.Do(ctx, method, d.Url, headers)
 	if err != nil {
-		return fmt.Errorf(fmt.Sprintf("Chunk fail %v", resp.StatusCode))
+		return fmt.Errorf("Chunk fail: %v", err)
 	}
+	defer resp.Body.Close()
 
 	if resp.StatusCode > 299 {
 		return fmt.Errorf(fmt.Sprintf("Can't process, response is %v", resp.StatusCode))
 	}
 
+	// 200 вместо 206 означает, что в теле весь файл, а не запрошенный диапазон:
+	// либо сервер не поддерживает Range, либо не выполнилось условие If-Range
+	if resp.StatusCode != http.StatusPartialContent {
+		if offset > 0 {
+			return ErrOriginChanged
+		}
+		return ErrRangeNotSupported
+	}
+
 	// Создаем директорию, если она не существует
 	if err := os.MkdirAll(d.DownloadDir, 0755); err != nil {
 		return fmt.Errorf("failed to create download directory: %v", err)
 	}
 
-	// Создаем временный файл в указанной директории
-	tmpFilePath := fmt.Sprintf("%s/%s-%v.tmp", d.DownloadDir, util.TMP_FILE_PREFIX, idx)
-	file, err := os.Create(tmpFilePath)
+	// Открываем временный файл: дописываем при докачке, иначе начинаем заново
+	flags := os.O_CREATE | os.O_WRONLY | os.O_APPEND
+	if offset == 0 {
+		flags |= os.O_TRUNC
+	}
+	file, err := os.OpenFile(tmpFilePath, flags, 0644)
 	if err != nil {
 		return fmt.Errorf("Can't create a file %v: %v", tmpFilePath, err)
 	}
 	defer file.Close()
 
 	// write to file
-	_, err = io.Copy(file, resp.Body)
+	dst, release := d.Throttle.DownloadWriter(ctx, d.TaskID, d.Url, &progressWriter{w: file, onProgress: d.OnProgress})
+	defer release()
+	written, err := io.Copy(dst, resp.Body)
 	if err != nil {
 		return fmt.Errorf("Failed to write to file: %v", err)
 	}
+	if offset+written != expected {
+		return fmt.Errorf("chunk %v is incomplete: got %v of %v bytes", idx, offset+written, expected)
+	}
 	log.Println(fmt.Sprintf("Wrote chunk %v to file %s", idx, tmpFilePath))
 
 	return nil
 }
 
-func (d *DownloadRequest) MergeDownloads() error {
+// ifRange возвращает валидатор для If-Range: ETag или, если его нет, Last-Modified.
+// Слабый ETag (W/"...") в If-Range запрещен RFC 9110 - сервер ответил бы всем файлом.
+func (d *DownloadRequest) ifRange() string {
+	if d.ETag != "" && !strings.HasPrefix(d.ETag, "W/") {
+		return d.ETag
+	}
+	return d.LastModified
+}
+
+// DownloadedBytes возвращает число байт, уже лежащих во временных файлах чанков
+func (d *DownloadRequest) DownloadedBytes() int64 {
+	var total int64
+	for idx := 0; idx < d.Chunks; idx++ {
+		if info, err := os.Stat(d.tmpFilePath(idx)); err == nil {
+			total += info.Size()
+		}
+	}
+	return total
+}
+
+// DownloadSingle скачивает файл целиком одним GET-запросом без Range.
+// Тело пишется во временный файл, который переименовывается в итоговый только после успешной загрузки.
+// Ответ сервера возвращается и при ошибке, если он был получен.
+func (d *DownloadRequest) DownloadSingle(ctx context.Context) (*http.Response, error) {
+	log.Printf("Downloading %s in a single stream", d.Url)
+	d.Chunks = 1
+
+	method := "GET"
+	headers := map[string]string{
+		"User-Agent": "CFD Downloader",
+	}
+	resp, err := d.HttpClient.Do(ctx, method, d.Url, headers)
+	if err != nil {
+		return nil, fmt.Errorf("request failed: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode > 299 {
+		return resp, fmt.Errorf("origin responded with %s", resp.Status)
+	}
+
+	if err := os.MkdirAll(d.DownloadDir, 0755); err != nil {
+		return resp, fmt.Errorf("failed to create download directory: %v", err)
+	}
+
+	tmpFilePath := d.tmpFilePath(0)
+	file, err := os.Create(tmpFilePath)
+	if err != nil {
+		return resp, fmt.Errorf("Can't create a file %v: %v", tmpFilePath, err)
+	}
+
+	dst, release := d.Throttle.DownloadWriter(ctx, d.TaskID, d.Url, &progressWriter{w: file, onProgress: d.OnProgress})
+	written, err := io.Copy(dst, resp.Body)
+	release()
+	file.Close()
+	if err != nil {
+		os.Remove(tmpFilePath)
+		return resp, fmt.Errorf("Failed to write to file: %v", err)
+	}
+	// Длина распакованного транспортом ответа неизвестна
+	if resp.ContentLength >= 0 && !resp.Uncompressed && written != resp.ContentLength {
+		os.Remove(tmpFilePath)
+		return resp, fmt.Errorf("%w: got %d bytes, Content-Length is %d", service.ErrIntegrity, written, resp.ContentLength)
+	}
+
+	outputFilePath := filepath.Join(d.DownloadDir, d.FileName)
+	if err := os.Rename(tmpFilePath, outputFilePath); err != nil {
+		os.Remove(tmpFilePath)
+		return resp, fmt.Errorf("failed to move %s to %s: %v", tmpFilePath, outputFilePath, err)
+	}
+
+	d.TotalSize = int(written)
+	log.Printf("Wrote %d bytes to file %s", written, outputFilePath)
+	return resp, nil
+}
+
+func (d *DownloadRequest) MergeDownloads(ctx context.Context) error {
 	// Создаем директорию, если она не существует
 	if err := os.MkdirAll(d.DownloadDir, 0755); err != nil {
 		return fmt.Errorf("failed to create download directory: %v", err)
 	}
 
 	// Создаем итоговый файл в указанной директории
-	outputFilePath := fmt.Sprintf("%s/%s", d.DownloadDir, d.FileName)
+	outputFilePath := filepath.Join(d.DownloadDir, d.FileName)
 	out, err := os.Create(outputFilePath)
 	if err != nil {
 		return fmt.Errorf("failed to create output file %s: %v", outputFilePath, err)
 	}
 	defer out.Close()
 
+	// Недосклеенный файл не должен попасть в архив
+	discard := func() {
+		out.Close()
+		os.Remove(outputFilePath)
+	}
+
 	// Объединяем все чанки
+	var merged int64
 	for idx := 0; idx < d.Chunks; idx++ {
-		tmpFilePath := fmt.Sprintf("%s/%s-%v.tmp", d.DownloadDir, util.TMP_FILE_PREFIX, idx)
+		if err := ctx.Err(); err != nil {
+			discard()
+			return err
+		}
+
+		tmpFilePath := d.tmpFilePath(idx)
 		in, err := os.Open(tmpFilePath)
 		if err != nil {
+			discard()
 			return fmt.Errorf("Failed to open chunk file %s: %v", tmpFilePath, err)
 		}
 
-		_, err = io.Copy(out, in)
+		n, err := io.Copy(out, in)
 		in.Close() // Закрываем файл сразу после использования
 		if err != nil {
+			discard()
 			return fmt.Errorf("Failed to merge chunk file %s: %v", tmpFilePath, err)
 		}
+		merged += n
+	}
+
+	// Склеенный файл должен совпасть по размеру с заявленным сервером
+	if merged != int64(d.TotalSize) {
+		discard()
+		return fmt.Errorf("%w: merged %d bytes, Content-Length is %d", service.ErrIntegrity, merged, d.TotalSize)
 	}
 
 	log.Printf("File chunks merged successfully to %s", outputFilePath)
@@ -116,13 +327,18 @@ func (d *DownloadRequest) CleanupTmpFiles() error {
 
 	// Удаляем все временные файлы
 	for idx := 0; idx < d.Chunks; idx++ {
-		tmpFilePath := fmt.Sprintf("%s/%s-%v.tmp", d.DownloadDir, util.TMP_FILE_PREFIX, idx)
+		tmpFilePath := d.tmpFilePath(idx)
 		err := os.Remove(tmpFilePath)
-		if err != nil {
+		if err != nil && !os.IsNotExist(err) {
 			// Продолжаем удалять другие файлы даже если один не удалился
 			log.Printf("Failed to remove chunk file %s: %v", tmpFilePath, err)
 		}
 	}
 
+	// Вместе с чанками удаляем и журнал прогресса
+	if err := os.Remove(d.journalPath()); err != nil && !os.IsNotExist(err) {
+		log.Printf("Failed to remove journal %s: %v", d.journalPath(), err)
+	}
+
 	return nil
 }
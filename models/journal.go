@@ -0,0 +1,105 @@
+package models
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/vldmir/zip-service/util"
+)
+
+// Journal - журнал прогресса загрузки файла по чанкам.
+// Хранится рядом с временными файлами чанков и позволяет продолжить загрузку
+// после сбоя чанка или перезапуска сервера, если файл на сервере не изменился.
+type Journal struct {
+	URL          string   `json:"url"`
+	ETag         string   `json:"etag,omitempty"`
+	LastModified string   `json:"last_modified,omitempty"`
+	TotalSize    int      `json:"total_size"`
+	Chunks       [][2]int `json:"chunks"`
+	Done         []bool   `json:"done"`
+
+	mu   sync.Mutex
+	path string
+}
+
+// journalPath возвращает путь к журналу прогресса файла внутри рабочей директории
+func (d *DownloadRequest) journalPath() string {
+	return filepath.Join(d.DownloadDir, fmt.Sprintf("%s-%s%s", util.TMP_FILE_PREFIX, d.FileName, util.JOURNAL_FILE_SUFFIX))
+}
+
+// NewJournal создает журнал для нового плана загрузки по чанкам
+func (d *DownloadRequest) NewJournal(chunks [][2]int) *Journal {
+	return &Journal{
+		URL:          d.Url,
+		ETag:         d.ETag,
+		LastModified: d.LastModified,
+		TotalSize:    d.TotalSize,
+		Chunks:       chunks,
+		Done:         make([]bool, len(chunks)),
+		path:         d.journalPath(),
+	}
+}
+
+// LoadJournal читает журнал прогресса файла с диска.
+// Журнал возвращается, только если он относится к той же версии файла на сервере.
+func (d *DownloadRequest) LoadJournal() (*Journal, bool) {
+	data, err := os.ReadFile(d.journalPath())
+	if err != nil {
+		return nil, false
+	}
+
+	j := &Journal{path: d.journalPath()}
+	if err := json.Unmarshal(data, j); err != nil {
+		return nil, false
+	}
+
+	if j.URL != d.Url || j.TotalSize != d.TotalSize || len(j.Chunks) == 0 || len(j.Done) != len(j.Chunks) {
+		return j, false
+	}
+	// Без валидатора, пригодного для If-Range, нельзя убедиться, что докачиваемые части от того же файла
+	if d.ifRange() == "" {
+		return j, false
+	}
+	if j.ETag != d.ETag || j.LastModified != d.LastModified {
+		return j, false
+	}
+
+	return j, true
+}
+
+// MarkDone отмечает чанк скачанным и сохраняет журнал
+func (j *Journal) MarkDone(idx int) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	j.Done[idx] = true
+	return j.save()
+}
+
+// Save сохраняет журнал на диск
+func (j *Journal) Save() error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	return j.save()
+}
+
+// save атомарно перезаписывает файл журнала, чтобы сбой не оставил его наполовину записанным
+func (j *Journal) save() error {
+	data, err := json.Marshal(j)
+	if err != nil {
+		return fmt.Errorf("failed to encode journal: %v", err)
+	}
+
+	tmpPath := j.path + ".tmp"
+	if err := os.WriteFile(tmpPath, data, 0644); err != nil {
+		return fmt.Errorf("failed to write journal %s: %v", tmpPath, err)
+	}
+	if err := os.Rename(tmpPath, j.path); err != nil {
+		return fmt.Errorf("failed to save journal %s: %v", j.path, err)
+	}
+	return nil
+}
@@ -0,0 +1,149 @@
+package service
+
+import (
+	"bytes"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"net/http"
+	"strings"
+)
+
+// Алгоритмы хешей, которыми проверяется содержимое файлов
+const (
+	ChecksumSHA256 = "sha256"
+	ChecksumMD5    = "md5"
+)
+
+// Откуда взят ожидаемый хеш файла
+const (
+	ChecksumFromClient     = "client"      // Задан при добавлении ссылки
+	ChecksumFromDigest     = "digest"      // Заголовок Repr-Digest или Digest ответа сервера
+	ChecksumFromContentMD5 = "content-md5" // Заголовок Content-MD5 ответа сервера
+	ChecksumFromETag       = "etag"        // ETag, похожий на MD5 содержимого (как у S3); может им и не быть
+)
+
+// Checksum - ожидаемый хеш содержимого файла
+type Checksum struct {
+	Algorithm string
+	Sum       []byte
+	Source    string
+}
+
+// ParseChecksum разбирает хеш, заданный клиентом, в виде "sha256:<hex>" или "md5:<hex>"
+func ParseChecksum(s string) (Checksum, error) {
+	alg, sum, ok := strings.Cut(strings.TrimSpace(s), ":")
+	if !ok {
+		return Checksum{}, fmt.Errorf("checksum %q must look like sha256:<hex> or md5:<hex>", s)
+	}
+	alg = normalizeAlgorithm(alg)
+	if alg == "" {
+		return Checksum{}, fmt.Errorf("unsupported checksum algorithm in %q, use sha256 or md5", s)
+	}
+
+	decoded, err := hex.DecodeString(sum)
+	if err != nil || len(decoded) != NewHash(alg).Size() {
+		return Checksum{}, fmt.Errorf("checksum %q is not a valid %s hex digest", s, alg)
+	}
+	return Checksum{Algorithm: alg, Sum: decoded, Source: ChecksumFromClient}, nil
+}
+
+// String возвращает хеш в том же виде, в каком его принимает ParseChecksum
+func (c Checksum) String() string {
+	return c.Algorithm + ":" + hex.EncodeToString(c.Sum)
+}
+
+// NewHash создает хеш по названию алгоритма; неизвестный алгоритм считается sha256
+func NewHash(alg string) hash.Hash {
+	if alg == ChecksumMD5 {
+		return md5.New()
+	}
+	return sha256.New()
+}
+
+// Matches сообщает, совпадает ли хеш с вычисленным sum
+func (c Checksum) Matches(sum []byte) bool {
+	return bytes.Equal(c.Sum, sum)
+}
+
+// OriginChecksum извлекает ожидаемый хеш файла из заголовков ответа сервера:
+// Repr-Digest (RFC 9530), Digest (RFC 3230), Content-MD5 или ETag из 32 шестнадцатеричных цифр.
+// Заголовки должны описывать файл целиком, а не часть из ответа на запрос диапазона.
+func OriginChecksum(h http.Header) (Checksum, bool) {
+	for _, header := range []string{"Repr-Digest", "Digest"} {
+		if c, ok := parseDigest(h.Values(header)); ok {
+			return c, true
+		}
+	}
+
+	if value := h.Get("Content-MD5"); value != "" {
+		if sum, err := base64.StdEncoding.DecodeString(strings.TrimSpace(value)); err == nil && len(sum) == md5.Size {
+			return Checksum{Algorithm: ChecksumMD5, Sum: sum, Source: ChecksumFromContentMD5}, true
+		}
+	}
+
+	// Слабый ETag по определению не описывает байты файла
+	etag := h.Get("ETag")
+	if !strings.HasPrefix(etag, "W/") {
+		if sum, err := hex.DecodeString(strings.Trim(etag, `"`)); err == nil && len(sum) == md5.Size {
+			return Checksum{Algorithm: ChecksumMD5, Sum: sum, Source: ChecksumFromETag}, true
+		}
+	}
+	return Checksum{}, false
+}
+
+// parseDigest разбирает значения вида "sha-256=<base64>" или "sha-256=:<base64>:", предпочитая sha256
+func parseDigest(values []string) (Checksum, bool) {
+	var found Checksum
+	for _, value := range values {
+		for _, item := range strings.Split(value, ",") {
+			alg, encoded, ok := strings.Cut(strings.TrimSpace(item), "=")
+			if !ok {
+				continue
+			}
+			alg = normalizeAlgorithm(alg)
+			if alg == "" {
+				continue
+			}
+			sum, err := base64.StdEncoding.DecodeString(strings.Trim(strings.TrimSpace(encoded), ":"))
+			if err != nil || len(sum) != NewHash(alg).Size() {
+				continue
+			}
+			if found.Algorithm == "" || alg == ChecksumSHA256 {
+				found = Checksum{Algorithm: alg, Sum: sum, Source: ChecksumFromDigest}
+			}
+		}
+	}
+	return found, found.Algorithm != ""
+}
+
+func normalizeAlgorithm(alg string) string {
+	switch strings.ToLower(strings.TrimSpace(alg)) {
+	case "sha256", "sha-256":
+		return ChecksumSHA256
+	case "md5":
+		return ChecksumMD5
+	}
+	return ""
+}
+
+// IntegrityStatus - результат проверки целостности скачанного файла
+type IntegrityStatus string
+
+const (
+	IntegrityVerified   IntegrityStatus = "verified"   // хеш совпал с ожидаемым
+	IntegrityMismatch   IntegrityStatus = "mismatch"   // хеш не совпал с ожидаемым
+	IntegrityUnverified IntegrityStatus = "unverified" // ожидаемый хеш неизвестен, проверен только размер
+)
+
+// Integrity - результат проверки целостности файла в статусе ссылки.
+// Actual - хеш скачанного файла, по которому клиент может проверить его сам.
+type Integrity struct {
+	Status   IntegrityStatus `json:"status"`
+	Source   string          `json:"source,omitempty"`   // Откуда взят ожидаемый хеш
+	Expected string          `json:"expected,omitempty"` // Ожидаемый хеш в виде "sha256:<hex>"
+	Actual   string          `json:"actual"`
+}
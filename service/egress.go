@@ -0,0 +1,200 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/vldmir/zip-service/config"
+)
+
+// ErrEgressDenied - ссылка ведет на адрес, запрещенный политикой исходящих запросов
+var ErrEgressDenied = errors.New("destination is not allowed by egress policy")
+
+// resolveTimeout ограничивает DNS-запрос при ранней проверке ссылки
+const resolveTimeout = 3 * time.Second
+
+// cgnatBlock - адреса Carrier-grade NAT (RFC 6598), в net.IP для них нет проверки
+var cgnatBlock = &net.IPNet{IP: net.IPv4(100, 64, 0, 0), Mask: net.CIDRMask(10, 32)}
+
+// EgressPolicy решает, к каким адресам сервис может обращаться по ссылкам пользователей.
+// Внутренние адреса (loopback, частные сети, link-local, multicast) запрещены всегда,
+// кроме явно разрешенных в allowed_cidrs. Проверяется и сама ссылка, и каждый редирект,
+// и IP-адрес, к которому фактически устанавливается соединение, поэтому подмена DNS-ответа
+// между проверкой и загрузкой (DNS rebinding) не помогает обойти политику.
+type EgressPolicy struct {
+	schemes      map[string]bool
+	allowedHosts []string
+	deniedHosts  []string
+	allowedNets  []*net.IPNet
+	deniedNets   []*net.IPNet
+	maxRedirects int
+}
+
+// NewEgressPolicy создает политику по настройкам egress из конфига.
+// Блоки CIDR уже проверены при загрузке конфига, некорректные пропускаются.
+func NewEgressPolicy(cfg config.EgressPolicy) *EgressPolicy {
+	p := &EgressPolicy{
+		schemes:      make(map[string]bool),
+		allowedHosts: normalizeHosts(cfg.AllowedHosts),
+		deniedHosts:  normalizeHosts(cfg.DeniedHosts),
+		allowedNets:  parseCIDRs(cfg.AllowedCIDRs),
+		deniedNets:   parseCIDRs(cfg.DeniedCIDRs),
+		maxRedirects: cfg.MaxRedirects,
+	}
+	for _, scheme := range cfg.AllowedSchemes {
+		p.schemes[strings.ToLower(strings.TrimSpace(scheme))] = true
+	}
+	return p
+}
+
+// CheckURL проверяет ссылку до постановки в задачу: схему, хост и адреса, в которые он резолвится.
+// Если хост сейчас не резолвится, ссылка допускается - адрес все равно проверяется при соединении.
+func (p *EgressPolicy) CheckURL(rawURL string) error {
+	u, err := p.checkTarget(rawURL)
+	if err != nil {
+		return err
+	}
+
+	host := u.Hostname()
+	if net.ParseIP(host) != nil {
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), resolveTimeout)
+	defer cancel()
+	addrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return nil
+	}
+	for _, addr := range addrs {
+		if err := p.checkIP(addr.IP); err != nil {
+			return fmt.Errorf("%w (resolved from %s)", err, host)
+		}
+	}
+	return nil
+}
+
+// checkTarget проверяет схему и хост ссылки без обращения к DNS
+func (p *EgressPolicy) checkTarget(rawURL string) (*url.URL, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidLink, err)
+	}
+	return u, p.checkURL(u)
+}
+
+func (p *EgressPolicy) checkURL(u *url.URL) error {
+	if !p.schemes[strings.ToLower(u.Scheme)] {
+		return fmt.Errorf("%w: scheme %q", ErrEgressDenied, u.Scheme)
+	}
+
+	host := strings.TrimSuffix(strings.ToLower(u.Hostname()), ".")
+	if host == "" {
+		return fmt.Errorf("%w: URL has no host", ErrEgressDenied)
+	}
+	if matchHost(p.deniedHosts, host) {
+		return fmt.Errorf("%w: host %s is denied", ErrEgressDenied, host)
+	}
+	if len(p.allowedHosts) > 0 && !matchHost(p.allowedHosts, host) {
+		return fmt.Errorf("%w: host %s is not in allowed_hosts", ErrEgressDenied, host)
+	}
+
+	if ip := net.ParseIP(host); ip != nil {
+		return p.checkIP(ip)
+	}
+	return nil
+}
+
+// checkIP проверяет адрес по denied_cidrs, allowed_cidrs и встроенному запрету внутренних адресов
+func (p *EgressPolicy) checkIP(ip net.IP) error {
+	if v4 := ip.To4(); v4 != nil {
+		ip = v4
+	}
+
+	if containsIP(p.deniedNets, ip) {
+		return fmt.Errorf("%w: address %s is denied", ErrEgressDenied, ip)
+	}
+	if containsIP(p.allowedNets, ip) {
+		return nil
+	}
+	if ip.IsLoopback() || ip.IsPrivate() || ip.IsUnspecified() ||
+		ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() ||
+		ip.IsInterfaceLocalMulticast() || ip.IsMulticast() || cgnatBlock.Contains(ip) {
+		return fmt.Errorf("%w: address %s is internal", ErrEgressDenied, ip)
+	}
+	return nil
+}
+
+// control вызывается net.Dialer перед каждым соединением с уже разрешенным IP-адресом
+func (p *EgressPolicy) control(network, address string, _ syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return fmt.Errorf("%w: bad address %s", ErrEgressDenied, address)
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return fmt.Errorf("%w: bad address %s", ErrEgressDenied, address)
+	}
+	return p.checkIP(ip)
+}
+
+// checkRedirect ограничивает число редиректов и проверяет ссылку, на которую ведет каждый из них
+func (p *EgressPolicy) checkRedirect(req *http.Request, via []*http.Request) error {
+	if len(via) > p.maxRedirects {
+		return fmt.Errorf("%w: stopped after %d redirects", ErrEgressDenied, p.maxRedirects)
+	}
+	return p.checkURL(req.URL)
+}
+
+// matchHost сообщает, подходит ли хост под один из шаблонов: точное имя или "*.example.com" для поддоменов
+func matchHost(patterns []string, host string) bool {
+	for _, pattern := range patterns {
+		if suffix, ok := strings.CutPrefix(pattern, "*"); ok {
+			if strings.HasSuffix(host, suffix) {
+				return true
+			}
+			continue
+		}
+		if host == pattern {
+			return true
+		}
+	}
+	return false
+}
+
+func normalizeHosts(hosts []string) []string {
+	normalized := make([]string, 0, len(hosts))
+	for _, host := range hosts {
+		host = strings.TrimSuffix(strings.ToLower(strings.TrimSpace(host)), ".")
+		if host != "" {
+			normalized = append(normalized, host)
+		}
+	}
+	return normalized
+}
+
+func parseCIDRs(blocks []string) []*net.IPNet {
+	nets := make([]*net.IPNet, 0, len(blocks))
+	for _, block := range blocks {
+		if _, ipNet, err := net.ParseCIDR(strings.TrimSpace(block)); err == nil {
+			nets = append(nets, ipNet)
+		}
+	}
+	return nets
+}
+
+func containsIP(nets []*net.IPNet, ip net.IP) bool {
+	for _, ipNet := range nets {
+		if ipNet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,18 @@
+package service
+
+import "errors"
+
+// Ошибки сервиса, по которым обработчики выбирают HTTP-статус ответа.
+// Конкретные ошибки оборачивают их через %w и дополняют подробностями.
+var (
+	ErrTaskNotFound    = errors.New("task not found")
+	ErrTaskState       = errors.New("operation is not allowed in the current task state")
+	ErrTooManyFiles    = errors.New("maximum files per task reached")
+	ErrUnsupportedType = errors.New("file type is not allowed")
+	ErrInvalidLink     = errors.New("invalid link")
+	ErrServerBusy      = errors.New("server busy")
+	ErrShuttingDown    = errors.New("server is shutting down")
+
+	// ErrIntegrity - скачанный файл не совпал с ожидаемым размером или хешем
+	ErrIntegrity = errors.New("integrity check failed")
+)
@@ -0,0 +1,167 @@
+package service
+
+import (
+	"fmt"
+	"mime"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+)
+
+// TypeFilter проверяет тип файлов по списку allowed_types из конфига.
+// Элементы списка - расширения (".pdf") или MIME-типы ("application/pdf");
+// для каждого расширения автоматически разрешается его MIME-тип и наоборот.
+type TypeFilter struct {
+	allowed []string
+	exts    map[string]bool
+	mimes   map[string]bool
+}
+
+// NewTypeFilter создает фильтр по списку разрешенных расширений и MIME-типов
+func NewTypeFilter(allowed []string) *TypeFilter {
+	f := &TypeFilter{
+		allowed: allowed,
+		exts:    make(map[string]bool),
+		mimes:   make(map[string]bool),
+	}
+
+	for _, item := range allowed {
+		item = strings.ToLower(strings.TrimSpace(item))
+		if strings.Contains(item, "/") {
+			f.mimes[item] = true
+			exts, _ := mime.ExtensionsByType(item)
+			for _, ext := range exts {
+				f.exts[ext] = true
+			}
+			continue
+		}
+
+		if !strings.HasPrefix(item, ".") {
+			item = "." + item
+		}
+		f.exts[item] = true
+		if mediaType := baseMediaType(mime.TypeByExtension(item)); mediaType != "" {
+			f.mimes[mediaType] = true
+		}
+	}
+
+	return f
+}
+
+// CheckURL проверяет расширение в пути ссылки, без учета query и fragment.
+// Ссылки без расширения допускаются - их тип проверяется по ответу сервера и содержимому.
+func (f *TypeFilter) CheckURL(rawURL string) error {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidLink, err)
+	}
+
+	return f.CheckName(u.Path)
+}
+
+// CheckName проверяет расширение имени файла; имена без расширения допускаются
+func (f *TypeFilter) CheckName(name string) error {
+	ext := strings.ToLower(path.Ext(name))
+	if ext == "" || f.exts[ext] {
+		return nil
+	}
+	return fmt.Errorf("%w: invalid file type %s, allowed types: %s", ErrUnsupportedType, ext, strings.Join(f.allowed, ", "))
+}
+
+// CheckContentType проверяет Content-Type из ответа сервера.
+// Пустой и обобщенный application/octet-stream не дают информации о типе и допускаются.
+func (f *TypeFilter) CheckContentType(contentType string) error {
+	mediaType := baseMediaType(contentType)
+	if mediaType == "" || mediaType == "application/octet-stream" || f.mimes[mediaType] {
+		return nil
+	}
+	return fmt.Errorf("%w: content type %s", ErrUnsupportedType, mediaType)
+}
+
+// genericContent - типы, которые сигнатура дает для содержимого без узнаваемых признаков
+// или для контейнеров многих форматов (docx, xlsx, jar - это ZIP)
+var genericContent = map[string]bool{
+	"application/octet-stream": true,
+	"text/plain":               true,
+	"application/zip":          true,
+}
+
+// sniffable - типы, которые http.DetectContentType узнает по сигнатуре.
+// Файл такого типа без его сигнатуры выдает себя за него, какой бы тип ни был заявлен.
+var sniffable = map[string]bool{
+	"application/pdf":               true,
+	"application/postscript":        true,
+	"application/ogg":               true,
+	"application/wasm":              true,
+	"application/x-gzip":            true,
+	"application/x-rar-compressed":  true,
+	"application/vnd.ms-fontobject": true,
+	"image/bmp":                     true,
+	"image/gif":                     true,
+	"image/jpeg":                    true,
+	"image/png":                     true,
+	"image/webp":                    true,
+	"image/x-icon":                  true,
+	"image/vnd.microsoft.icon":      true,
+	"audio/aiff":                    true,
+	"audio/midi":                    true,
+	"audio/mpeg":                    true,
+	"audio/wave":                    true,
+	"video/avi":                     true,
+	"video/mp4":                     true,
+	"video/webm":                    true,
+	"font/collection":               true,
+	"font/otf":                      true,
+	"font/ttf":                      true,
+	"font/woff":                     true,
+	"font/woff2":                    true,
+	"text/html":                     true,
+	"text/xml":                      true,
+}
+
+// CheckContent определяет тип файла по первым байтам содержимого (magic bytes)
+// и возвращает определенный тип вместе с ошибкой, если он не разрешен.
+// Обобщенный тип не опровергает заявленный ссылкой rawURL, именем файла name или Content-Type
+// разрешенный тип только тогда, когда у того нет узнаваемой сигнатуры (например, docx или csv);
+// PDF, JPEG, PNG и другие узнаваемые типы должны совпасть по сигнатуре.
+func (f *TypeFilter) CheckContent(head []byte, rawURL, name, contentType string) (string, error) {
+	mediaType := baseMediaType(http.DetectContentType(head))
+	if f.mimes[mediaType] {
+		return mediaType, nil
+	}
+	if genericContent[mediaType] && f.declaresUnsniffable(rawURL, name, contentType) {
+		return mediaType, nil
+	}
+	return mediaType, fmt.Errorf("%w: file content looks like %s", ErrUnsupportedType, mediaType)
+}
+
+// declaresUnsniffable сообщает, заявлен ли расширением ссылки или имени файла либо Content-Type
+// разрешенный тип, который нельзя подтвердить сигнатурой
+func (f *TypeFilter) declaresUnsniffable(rawURL, name, contentType string) bool {
+	var exts []string
+	if u, err := url.Parse(rawURL); err == nil {
+		exts = append(exts, strings.ToLower(path.Ext(u.Path)))
+	}
+	exts = append(exts, strings.ToLower(path.Ext(name)))
+	for _, ext := range exts {
+		if f.exts[ext] && !sniffable[baseMediaType(mime.TypeByExtension(ext))] {
+			return true
+		}
+	}
+
+	mediaType := baseMediaType(contentType)
+	return f.mimes[mediaType] && !sniffable[mediaType]
+}
+
+// baseMediaType возвращает MIME-тип без параметров в нижнем регистре
+func baseMediaType(contentType string) string {
+	if contentType == "" {
+		return ""
+	}
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return ""
+	}
+	return strings.ToLower(mediaType)
+}
@@ -2,18 +2,51 @@ package service
 
 import (
 	"bytes"
+	"context"
+	"errors"
+	"io"
 	"io/ioutil"
+	"log"
+	"math/rand"
+	"net"
 	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/vldmir/zip-service/config"
 )
 
 type HTTPClient struct {
 	client *http.Client
+	retry  config.RetryPolicy
+	sched  *ConnScheduler
 }
 
-// NewHTTPClient creates a new instance of HTTPClient.
-func NewHTTPClient() *HTTPClient {
+// NewHTTPClient creates a new instance of HTTPClient that retries transient failures according to retry.
+// Every connection and redirect is checked against egress; proxies from the environment are not used,
+// so the address being dialed is always the origin itself.
+// Each request holds a slot in sched until its response body is closed; a nil sched means no limit.
+func NewHTTPClient(retry config.RetryPolicy, egress *EgressPolicy, sched *ConnScheduler) *HTTPClient {
+	if retry.MaxAttempts < 1 {
+		retry.MaxAttempts = 1
+	}
+
+	dialer := &net.Dialer{
+		Timeout:   30 * time.Second,
+		KeepAlive: 30 * time.Second,
+		Control:   egress.control,
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = nil
+	transport.DialContext = dialer.DialContext
+
 	return &HTTPClient{
-		client: &http.Client{},
+		client: &http.Client{
+			Transport:     transport,
+			CheckRedirect: egress.checkRedirect,
+		},
+		retry: retry,
+		sched: sched,
 	}
 }
 
@@ -27,9 +60,9 @@ func (c *HTTPClient) DoRequest(req *http.Request) (*http.Response, error) {
 	return resp, nil
 }
 
-// NewRequest creates a new HTTP request with the specified method, URL, headers, and body.
-func (c *HTTPClient) NewRequest(method, url string, headers map[string]string, body []byte) (*http.Request, error) {
-	req, err := http.NewRequest(method, url, nil)
+// NewRequest creates a new HTTP request bound to ctx with the specified method, URL, headers, and body.
+func (c *HTTPClient) NewRequest(ctx context.Context, method, url string, headers map[string]string, body []byte) (*http.Request, error) {
+	req, err := http.NewRequestWithContext(ctx, method, url, nil)
 	if err != nil {
 		return nil, err
 	}
@@ -45,16 +78,144 @@ func (c *HTTPClient) NewRequest(method, url string, headers map[string]string, b
 	return req, nil
 }
 
-// User function
-func (c *HTTPClient) Do(method string, url string, headers map[string]string) (*http.Response, error) {
-	req, err := c.NewRequest(method, url, headers, nil)
-	if err != nil {
-		return nil, err
+// Do performs a request without body; cancelling ctx aborts the request and the response body read.
+// Network errors and retryable statuses are retried with exponential backoff, honoring Retry-After.
+// After the last attempt the final response is returned as is, so callers still see its status.
+func (c *HTTPClient) Do(ctx context.Context, method string, url string, headers map[string]string) (*http.Response, error) {
+	for attempt := 1; ; attempt++ {
+		req, err := c.NewRequest(ctx, method, url, headers, nil)
+		if err != nil {
+			return nil, err
+		}
+
+		release, err := c.acquire(ctx, req)
+		if err != nil {
+			return nil, err
+		}
+		resp, err := c.DoRequest(req)
+		if err != nil {
+			release()
+		} else {
+			resp.Body = &releasingBody{ReadCloser: resp.Body, release: release}
+		}
+		if ctx.Err() != nil {
+			if resp != nil {
+				resp.Body.Close()
+			}
+			return nil, ctx.Err()
+		}
+		// A policy violation will not go away on retry
+		if errors.Is(err, ErrEgressDenied) {
+			return nil, err
+		}
+		if attempt >= c.retry.MaxAttempts || (err == nil && !c.isRetryable(resp.StatusCode)) {
+			return resp, err
+		}
+
+		delay := c.Backoff(attempt)
+		if err != nil {
+			log.Printf("%s %s failed (attempt %d/%d): %v, retrying in %v", method, url, attempt, c.retry.MaxAttempts, err, delay)
+		} else {
+			if after, ok := retryAfter(resp); ok {
+				delay = min(after, c.retry.MaxBackoff)
+			}
+			log.Printf("%s %s responded %s (attempt %d/%d), retrying in %v", method, url, resp.Status, attempt, c.retry.MaxAttempts, delay)
+			io.Copy(io.Discard, io.LimitReader(resp.Body, 4096))
+			resp.Body.Close()
+		}
+
+		if err := Sleep(ctx, delay); err != nil {
+			return nil, err
+		}
 	}
-	resp, err := c.DoRequest(req)
-	if err != nil {
-		return nil, err
+}
+
+// acquire waits for a scheduler slot for req on behalf of the task ctx is tagged with.
+func (c *HTTPClient) acquire(ctx context.Context, req *http.Request) (func(), error) {
+	if c.sched == nil {
+		return func() {}, nil
 	}
+	return c.sched.Acquire(ctx, taskFrom(ctx), req.URL.Hostname())
+}
 
-	return resp, nil
+// releasingBody gives the scheduler slot back once the response body is closed.
+type releasingBody struct {
+	io.ReadCloser
+	release func()
+}
+
+func (b *releasingBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.release()
+	return err
+}
+
+// MaxAttempts returns how many times a request is attempted in total.
+func (c *HTTPClient) MaxAttempts() int {
+	return c.retry.MaxAttempts
+}
+
+// Backoff returns the pause before the attempt following attempt:
+// BaseBackoff doubled on every attempt, capped by MaxBackoff and randomized by Jitter.
+func (c *HTTPClient) Backoff(attempt int) time.Duration {
+	delay := c.retry.BaseBackoff
+	for i := 1; i < attempt && delay < c.retry.MaxBackoff; i++ {
+		delay *= 2
+	}
+	if c.retry.MaxBackoff > 0 && delay > c.retry.MaxBackoff {
+		delay = c.retry.MaxBackoff
+	}
+
+	if c.retry.Jitter > 0 {
+		delta := float64(delay) * c.retry.Jitter
+		delay += time.Duration(delta * (2*rand.Float64() - 1))
+	}
+	if delay < 0 {
+		delay = 0
+	}
+	return delay
+}
+
+func (c *HTTPClient) isRetryable(status int) bool {
+	for _, s := range c.retry.RetryableStatuses {
+		if s == status {
+			return true
+		}
+	}
+	return false
+}
+
+// retryAfter parses the Retry-After header given either in seconds or as an HTTP date.
+func retryAfter(resp *http.Response) (time.Duration, bool) {
+	value := resp.Header.Get("Retry-After")
+	if value == "" {
+		return 0, false
+	}
+
+	if seconds, err := strconv.Atoi(value); err == nil && seconds >= 0 {
+		return time.Duration(seconds) * time.Second, true
+	}
+
+	if date, err := http.ParseTime(value); err == nil {
+		delay := time.Until(date)
+		if delay < 0 {
+			delay = 0
+		}
+		return delay, true
+	}
+
+	return 0, false
+}
+
+// Sleep waits for d or until ctx is cancelled.
+func Sleep(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
 }
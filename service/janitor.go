@@ -0,0 +1,195 @@
+package service
+
+import (
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Janitor периодически удаляет задачи с истекшим сроком хранения вместе с их рабочими директориями
+// (скачанными файлами, временными файлами чанков и архивами), а при превышении disk_high_water_mb
+// досрочно удаляет самые давно не менявшиеся завершенные задачи
+type Janitor struct {
+	ls   *LinkService
+	stop chan struct{}
+	done chan struct{}
+}
+
+// StartJanitor запускает уборку в фоне с периодом retention.sweep_interval из конфига
+func StartJanitor(ls *LinkService) *Janitor {
+	j := &Janitor{
+		ls:   ls,
+		stop: make(chan struct{}),
+		done: make(chan struct{}),
+	}
+	go j.loop()
+	return j
+}
+
+// Stop останавливает уборку и дожидается завершения текущего прохода
+func (j *Janitor) Stop() {
+	close(j.stop)
+	<-j.done
+}
+
+func (j *Janitor) loop() {
+	defer close(j.done)
+
+	ticker := time.NewTicker(j.ls.cfg.Retention.SweepInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-j.stop:
+			return
+		case <-ticker.C:
+			j.Sweep(time.Now())
+		}
+	}
+}
+
+// Sweep выполняет один проход уборки
+func (j *Janitor) Sweep(now time.Time) {
+	for _, task := range j.ls.expireTasks(now) {
+		log.Printf("Task %s expired in state %s, removing it", task.ID, task.Status)
+		j.remove(task)
+	}
+
+	for _, dir := range j.ls.orphanWorkspaces() {
+		log.Printf("Removing workspace %s without a task", dir)
+		if err := os.RemoveAll(dir); err != nil {
+			log.Printf("Failed to remove workspace %s: %v", dir, err)
+		}
+	}
+
+	limit := int64(j.ls.cfg.Retention.DiskHighWaterMB) << 20
+	if limit <= 0 {
+		return
+	}
+	usage := dirSize(j.ls.cfg.Storage.DownloadDir)
+	if usage <= limit {
+		return
+	}
+	for _, task := range j.ls.evictTasks(usage - limit) {
+		log.Printf("Disk usage %d MB exceeds disk_high_water_mb, evicting task %s", usage>>20, task.ID)
+		j.remove(task)
+	}
+}
+
+func (j *Janitor) remove(task Task) {
+	if err := removeWorkspace(task); err != nil {
+		log.Printf("%v", err)
+	}
+}
+
+// ttl возвращает срок хранения задачи в её текущем состоянии; 0 - задача не удаляется
+func (ls *LinkService) ttl(status TaskStatus) time.Duration {
+	switch status {
+	case StatusCreated, StatusAborted:
+		return ls.cfg.Retention.IdleTTL
+	case StatusCompleted:
+		return ls.cfg.Retention.CompletedTTL
+	case StatusFailed, StatusCancelled:
+		return ls.cfg.Retention.FailedTTL
+	}
+	return 0
+}
+
+// expireTasks удаляет из хранилища задачи с истекшим сроком хранения и возвращает их.
+// Рабочие директории удаляет вызывающий, уже без блокировки сервиса.
+func (ls *LinkService) expireTasks(now time.Time) []Task {
+	ls.mu.Lock()
+	defer ls.mu.Unlock()
+
+	var expired []Task
+	for _, task := range ls.store.List() {
+		ttl := ls.ttl(task.Status)
+		if ttl <= 0 || now.Sub(task.UpdatedAt) < ttl {
+			continue
+		}
+		if err := ls.store.Delete(task.ID); err != nil {
+			continue
+		}
+		expired = append(expired, task)
+	}
+	return expired
+}
+
+// evictTasks удаляет из хранилища завершенные, неудачные и прерванные задачи, начиная с давно
+// не менявшихся, пока их рабочие директории не освободят хотя бы need байт, и возвращает их
+func (ls *LinkService) evictTasks(need int64) []Task {
+	ls.mu.Lock()
+	defer ls.mu.Unlock()
+
+	var candidates []Task
+	for _, task := range ls.store.List() {
+		if !task.Status.IsActive() {
+			candidates = append(candidates, task)
+		}
+	}
+	sort.Slice(candidates, func(i, j int) bool {
+		return candidates[i].UpdatedAt.Before(candidates[j].UpdatedAt)
+	})
+
+	var evicted []Task
+	for _, task := range candidates {
+		if need <= 0 {
+			break
+		}
+		if err := ls.store.Delete(task.ID); err != nil {
+			continue
+		}
+		need -= dirSize(task.Dir)
+		evicted = append(evicted, task)
+	}
+	return evicted
+}
+
+// orphanWorkspaces возвращает рабочие директории в download_dir, для которых нет задачи,
+// например оставшиеся после перезапуска с хранилищем memory
+func (ls *LinkService) orphanWorkspaces() []string {
+	// Блокировка не дает принять за сироту директорию задачи, которая прямо сейчас создается
+	ls.mu.Lock()
+	defer ls.mu.Unlock()
+
+	entries, err := os.ReadDir(ls.cfg.Storage.DownloadDir)
+	if err != nil {
+		return nil
+	}
+
+	var orphans []string
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		// Рабочие директории называются по UUID задачи, остальное не трогаем
+		if _, err := uuid.Parse(entry.Name()); err != nil {
+			continue
+		}
+		if _, exists := ls.store.Get(entry.Name()); exists {
+			continue
+		}
+		orphans = append(orphans, filepath.Join(ls.cfg.Storage.DownloadDir, entry.Name()))
+	}
+	return orphans
+}
+
+// dirSize возвращает суммарный размер файлов в директории
+func dirSize(dir string) int64 {
+	var size int64
+	filepath.WalkDir(dir, func(_ string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return nil
+		}
+		if info, err := d.Info(); err == nil {
+			size += info.Size()
+		}
+		return nil
+	})
+	return size
+}
@@ -0,0 +1,27 @@
+package service
+
+// LinkState описывает состояние загрузки отдельной ссылки задачи
+type LinkState string
+
+const (
+	LinkPending     LinkState = "pending"     // ссылка ждет загрузки
+	LinkDownloading LinkState = "downloading" // файл скачивается
+	LinkDone        LinkState = "done"        // файл скачан и попадет в архив
+	LinkFailed      LinkState = "failed"      // файл не удалось скачать
+)
+
+// Link - запись о ссылке задачи и ходе её загрузки
+type Link struct {
+	URL             string    `json:"url"`
+	Name            string    `json:"name,omitempty"`      // Имя файла, заданное пользователем
+	FileName        string    `json:"file_name,omitempty"` // Имя файла в архиве
+	State           LinkState `json:"state"`
+	BytesDownloaded int64     `json:"bytes_downloaded"`
+	ContentLength   int64     `json:"content_length"`
+	HTTPStatus      int       `json:"http_status,omitempty"`
+	ContentType     string    `json:"content_type,omitempty"`
+	Error           string    `json:"error,omitempty"`
+
+	Checksum  string     `json:"checksum,omitempty"`  // Ожидаемый хеш, заданный клиентом, в виде "sha256:<hex>"
+	Integrity *Integrity `json:"integrity,omitempty"` // Результат проверки целостности; заменяется целиком, не изменяется
+}
@@ -2,135 +2,560 @@ package service
 
 import (
 	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
 	"sync"
+	"time"
 
 	"github.com/google/uuid"
 	"github.com/vldmir/zip-service/config"
-	"strings"
+	"github.com/vldmir/zip-service/util"
 )
 
 type Task struct {
-	ID    string
-	Links []string
-	Status string
+	ID          string     `json:"id"`
+	Links       []Link     `json:"links"`
+	Status      TaskStatus `json:"status"`
+	Error       string     `json:"error,omitempty"`        // Причина неудачи, если задача завершилась с ошибкой
+	Dir         string     `json:"dir"`                    // Рабочая директория задачи, в которую скачиваются файлы
+	ArchivePath string     `json:"archive_path,omitempty"` // Путь к готовому архиву на диске
+	CreatedAt   time.Time  `json:"created_at"`             // Время создания задачи
+	UpdatedAt   time.Time  `json:"updated_at"`             // Время последнего изменения задачи, от него отсчитывается срок хранения
+}
+
+// clone возвращает копию задачи, не разделяющую с ней список ссылок.
+// Список ссылок не бывает nil, чтобы задача без ссылок отдавалась как "links": [].
+func (t Task) clone() Task {
+	t.Links = append(make([]Link, 0, len(t.Links)), t.Links...)
+	return t
 }
 
 type LinkService struct {
-	tasks map[string]*Task
-	mu    sync.RWMutex
-	cfg   *config.Config
+	store    TaskStore
+	mu       sync.RWMutex // Делает чтение-изменение-запись задачи в store атомарным
+	cfg      *config.Config
+	types    *TypeFilter
+	egress   *EgressPolicy
+	throttle *Throttle
+	onFull   func(taskID string) // Вызывается, когда задача набрала MaxFilesPerTask ссылок
 }
 
-func New(cfg *config.Config) *LinkService {
+// New создает сервис задач поверх хранилища store
+func New(cfg *config.Config, store TaskStore) *LinkService {
 	return &LinkService{
-		tasks: make(map[string]*Task),
-		cfg:   cfg,
+		store:    store,
+		cfg:      cfg,
+		types:    NewTypeFilter(cfg.AllowedTypes),
+		egress:   NewEgressPolicy(cfg.Egress),
+		throttle: NewThrottle(cfg.Throttle),
 	}
 }
 
-// CreateTask создает новую задачу и возвращает её UUID
-func (ls *LinkService) CreateTask() string {
+// Config возвращает конфигурацию сервиса
+func (ls *LinkService) Config() *config.Config {
+	return ls.cfg
+}
+
+// Types возвращает фильтр разрешенных типов файлов
+func (ls *LinkService) Types() *TypeFilter {
+	return ls.types
+}
+
+// Egress возвращает политику исходящих запросов к ссылкам пользователей
+func (ls *LinkService) Egress() *EgressPolicy {
+	return ls.egress
+}
+
+// Throttle возвращает ограничитель скорости загрузок и отдачи архивов
+func (ls *LinkService) Throttle() *Throttle {
+	return ls.throttle
+}
+
+// CreateTask создает новую задачу вместе с её рабочей директорией и возвращает UUID задачи.
+// Если активных задач уже MaxConcurrentTasks, возвращается ErrServerBusy.
+func (ls *LinkService) CreateTask() (string, error) {
 	ls.mu.Lock()
 	defer ls.mu.Unlock()
 
+	if ls.activeTasksCount() >= ls.cfg.Limits.MaxConcurrentTasks {
+		return "", fmt.Errorf("%w: too many active tasks", ErrServerBusy)
+	}
+
 	taskID := uuid.New().String()
-	ls.tasks[taskID] = &Task{
-		ID:    taskID,
-		Links: make([]string, 0),
-		Status: "processing",
+	dir := filepath.Join(ls.cfg.Storage.DownloadDir, taskID)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", fmt.Errorf("failed to create task workspace: %v", err)
 	}
-	return taskID
+
+	err := ls.save(Task{
+		ID:        taskID,
+		Links:     make([]Link, 0),
+		Status:    StatusCreated,
+		Dir:       dir,
+		CreatedAt: time.Now(),
+	})
+	if err != nil {
+		os.RemoveAll(dir)
+		return "", err
+	}
+	return taskID, nil
+}
+
+// save отмечает время изменения задачи и сохраняет её в store
+func (ls *LinkService) save(task Task) error {
+	task.UpdatedAt = time.Now()
+	return ls.store.Put(task)
+}
+
+// OnTaskFull регистрирует обработчик, который запускает задачу,
+// как только в неё добавлена последняя разрешенная ссылка
+func (ls *LinkService) OnTaskFull(fn func(taskID string)) {
+	ls.mu.Lock()
+	defer ls.mu.Unlock()
+	ls.onFull = fn
 }
 
-func isValidFileType(url string) bool {
-    allowedExtensions := []string{".pdf", ".jpeg", ".jpg"}
-    for _, ext := range allowedExtensions {
-        if strings.HasSuffix(strings.ToLower(url), ext) {
-            return true
-        }
-    }
-    return false
+// NewLink - ссылка, добавляемая в задачу, с необязательными именем файла в архиве
+// и ожидаемым хешем содержимого ("sha256:<hex>" или "md5:<hex>")
+type NewLink struct {
+	URL      string
+	Name     string
+	Checksum string
+}
+
+// AddLink добавляет ссылку в указанную задачу. Необязательное name задает имя файла в архиве
+// вместо имени из ответа сервера или ссылки, а необязательный checksum - ожидаемый хеш содержимого.
+// Если после добавления достигнут лимит MaxFilesPerTask, задача запускается автоматически.
+func (ls *LinkService) AddLink(taskID, link, name, checksum string) error {
+	errs, err := ls.AddLinks(taskID, []NewLink{{URL: link, Name: name, Checksum: checksum}})
+	if err != nil {
+		return err
+	}
+	return errs[0]
+}
+
+// AddLinks добавляет в задачу несколько ссылок, проверяя каждую отдельно, и возвращает
+// ошибку для каждой отклоненной ссылки (nil - ссылка принята) в порядке входного списка.
+// Лимит MaxFilesPerTask проверяется под одной блокировкой для всего списка: ссылки принимаются
+// по порядку, пока есть место, и параллельные добавления не могут его превысить.
+// Ошибка уровня задачи (задача не найдена или уже запущена) возвращается вторым значением.
+func (ls *LinkService) AddLinks(taskID string, links []NewLink) ([]error, error) {
+	errs := make([]error, len(links))
+	checked := make([]Link, len(links))
+	// Адреса проверяем до блокировки сервиса - проверка может обращаться к DNS
+	for i, link := range links {
+		checked[i], errs[i] = ls.checkLink(link)
+	}
+
+	full, err := ls.addLinks(taskID, checked, errs)
+	if err != nil {
+		return nil, err
+	}
+
+	ls.mu.RLock()
+	onFull := ls.onFull
+	ls.mu.RUnlock()
+
+	if full && onFull != nil {
+		onFull(taskID)
+	}
+	return errs, nil
+}
+
+// checkLink проверяет адрес и имя файла ссылки и возвращает запись для задачи
+func (ls *LinkService) checkLink(link NewLink) (Link, error) {
+	if link.URL == "" {
+		return Link{}, fmt.Errorf("%w: link is empty", ErrInvalidLink)
+	}
+	if err := ls.egress.CheckURL(link.URL); err != nil {
+		return Link{}, err
+	}
+
+	name := link.Name
+	if name != "" {
+		name = util.SanitizeFileName(link.Name)
+		if name == "" {
+			return Link{}, fmt.Errorf("%w: invalid file name %q", ErrInvalidLink, link.Name)
+		}
+		if err := ls.types.CheckName(name); err != nil {
+			return Link{}, err
+		}
+	}
+
+	var checksum string
+	if link.Checksum != "" {
+		sum, err := ParseChecksum(link.Checksum)
+		if err != nil {
+			return Link{}, fmt.Errorf("%w: %v", ErrInvalidLink, err)
+		}
+		checksum = sum.String()
+	}
+
+	return Link{URL: link.URL, Name: name, Checksum: checksum, State: LinkPending}, nil
 }
 
-// AddLink добавляет ссылку в указанную задачу
-func (ls *LinkService) AddLink(taskID, link string) error {
+// addLinks добавляет в задачу прошедшие проверку ссылки (errs[i] == nil), записывая в errs
+// причины отказа, и сообщает, набрала ли задача MaxFilesPerTask ссылок
+func (ls *LinkService) addLinks(taskID string, links []Link, errs []error) (bool, error) {
 	ls.mu.Lock()
 	defer ls.mu.Unlock()
 
-	task, exists := ls.tasks[taskID]
+	task, exists := ls.store.Get(taskID)
 	if !exists {
-		return fmt.Errorf("task with ID %s not found", taskID)
+		return false, fmt.Errorf("%w: %s", ErrTaskNotFound, taskID)
 	}
 
-	    // Проверка лимита файлов
-    if len(task.Links) >= ls.cfg.Limits.MaxFilesPerTask {
-        return fmt.Errorf("maximum files per task reached")
-    }
+	if task.Status != StatusCreated {
+		return false, fmt.Errorf("%w: task %s is already %s", ErrTaskState, taskID, task.Status)
+	}
 
-	    // Проверка типа файла
-    if !isValidFileType(link) {
-        return fmt.Errorf("invalid file type, only .pdf and .jpeg allowed")
-    }
-    
+	added := false
+	for i, link := range links {
+		if errs[i] != nil {
+			continue
+		}
 
-	task.Links = append(task.Links, link)
-	return nil
+		// Проверка лимита файлов
+		if len(task.Links) >= ls.cfg.Limits.MaxFilesPerTask {
+			errs[i] = fmt.Errorf("%w (%d)", ErrTooManyFiles, ls.cfg.Limits.MaxFilesPerTask)
+			continue
+		}
+
+		// Проверка типа файла по расширению в пути ссылки
+		if err := ls.types.CheckURL(link.URL); err != nil {
+			errs[i] = err
+			continue
+		}
+
+		task.Links = append(task.Links, link)
+		added = true
+	}
+
+	if err := ls.save(task); err != nil {
+		return false, err
+	}
+	return added && len(task.Links) == ls.cfg.Limits.MaxFilesPerTask, nil
 }
 
 // GetLinks возвращает ссылки для указанной задачи
 func (ls *LinkService) GetLinks(taskID string) ([]string, error) {
-	ls.mu.RLock()
-	defer ls.mu.RUnlock()
+	task, exists := ls.store.Get(taskID)
+	if !exists {
+		return nil, fmt.Errorf("%w: %s", ErrTaskNotFound, taskID)
+	}
 
-	task, exists := ls.tasks[taskID]
+	links := make([]string, 0, len(task.Links))
+	for _, link := range task.Links {
+		links = append(links, link.URL)
+	}
+	return links, nil
+}
+
+// UpdateLink изменяет запись о ссылке с индексом idx под блокировкой сервиса
+func (ls *LinkService) UpdateLink(taskID string, idx int, update func(link *Link)) error {
+	ls.mu.Lock()
+	defer ls.mu.Unlock()
+
+	task, exists := ls.store.Get(taskID)
 	if !exists {
-		return nil, fmt.Errorf("task with ID %s not found", taskID)
+		return fmt.Errorf("%w: %s", ErrTaskNotFound, taskID)
 	}
 
-	return task.Links, nil
+	if idx < 0 || idx >= len(task.Links) {
+		return fmt.Errorf("task %s has no link #%d", taskID, idx)
+	}
+
+	update(&task.Links[idx])
+	return ls.save(task)
 }
 
-// ClearTask очищает указанную задачу
+// ResetLinks возвращает недокачанные ссылки задачи в состояние pending перед новым запуском.
+// Уже скачанные ссылки сохраняют состояние done, чтобы прерванная задача продолжилась с места остановки.
+func (ls *LinkService) ResetLinks(taskID string) error {
+	ls.mu.Lock()
+	defer ls.mu.Unlock()
+
+	task, exists := ls.store.Get(taskID)
+	if !exists {
+		return fmt.Errorf("%w: %s", ErrTaskNotFound, taskID)
+	}
+
+	for i := range task.Links {
+		if task.Links[i].State == LinkDone {
+			continue
+		}
+		link := task.Links[i]
+		task.Links[i] = Link{URL: link.URL, Name: link.Name, Checksum: link.Checksum, State: LinkPending}
+	}
+	return ls.save(task)
+}
+
+// GetTask возвращает копию задачи, безопасную для чтения без блокировки
+func (ls *LinkService) GetTask(taskID string) (Task, error) {
+	task, exists := ls.store.Get(taskID)
+	if !exists {
+		return Task{}, fmt.Errorf("%w: %s", ErrTaskNotFound, taskID)
+	}
+	return task, nil
+}
+
+// ListTasks возвращает копии всех задач в порядке создания
+func (ls *LinkService) ListTasks() []Task {
+	tasks := ls.store.List()
+	sort.Slice(tasks, func(i, j int) bool {
+		return tasks[i].CreatedAt.Before(tasks[j].CreatedAt)
+	})
+	return tasks
+}
+
+// SetStatus переводит задачу в новое состояние, если такой переход допустим
+func (ls *LinkService) SetStatus(taskID string, status TaskStatus) error {
+	ls.mu.Lock()
+	defer ls.mu.Unlock()
+
+	task, exists := ls.store.Get(taskID)
+	if !exists {
+		return fmt.Errorf("%w: %s", ErrTaskNotFound, taskID)
+	}
+
+	if !CanTransition(task.Status, status) {
+		return fmt.Errorf("%w: task %s cannot move from %s to %s", ErrTaskState, taskID, task.Status, status)
+	}
+
+	task.Status = status
+	if status == StatusQueued {
+		task.Error = ""
+	}
+	return ls.save(task)
+}
+
+// QueueTask ставит задачу в очередь на выполнение (переводит в queued) и возвращает её прежнее состояние.
+// Незапущенная задача уже учтена в MaxConcurrentTasks при создании, а повторный запуск
+// прерванной, выполненной или неудачной задачи снова делает её активной,
+// поэтому при достигнутом лимите возвращается ErrServerBusy. Задачу без ссылок запустить нельзя.
+func (ls *LinkService) QueueTask(taskID string) (Task, error) {
+	ls.mu.Lock()
+	defer ls.mu.Unlock()
+
+	task, exists := ls.store.Get(taskID)
+	if !exists {
+		return Task{}, fmt.Errorf("%w: %s", ErrTaskNotFound, taskID)
+	}
+	prev := task
+
+	if !CanTransition(task.Status, StatusQueued) {
+		return prev, fmt.Errorf("%w: task %s cannot move from %s to %s", ErrTaskState, taskID, task.Status, StatusQueued)
+	}
+	if len(task.Links) == 0 {
+		return prev, fmt.Errorf("%w: task %s has no links", ErrTaskState, taskID)
+	}
+	if !task.Status.IsActive() && ls.activeTasksCount() >= ls.cfg.Limits.MaxConcurrentTasks {
+		return prev, fmt.Errorf("%w: too many active tasks", ErrServerBusy)
+	}
+
+	task.Status = StatusQueued
+	task.Error = ""
+	return prev, ls.save(task)
+}
+
+// UnqueueTask возвращает задаче состояние и ошибку из prev, если её не удалось поставить в очередь.
+// Задача, которую за это время уже отменили или запустили, не меняется.
+func (ls *LinkService) UnqueueTask(prev Task) error {
+	ls.mu.Lock()
+	defer ls.mu.Unlock()
+
+	task, exists := ls.store.Get(prev.ID)
+	if !exists {
+		return fmt.Errorf("%w: %s", ErrTaskNotFound, prev.ID)
+	}
+	if task.Status != StatusQueued {
+		return fmt.Errorf("%w: task %s is %s, not %s", ErrTaskState, prev.ID, task.Status, StatusQueued)
+	}
+
+	task.Status = prev.Status
+	task.Error = prev.Error
+	return ls.save(task)
+}
+
+// CompleteTask сохраняет путь к готовому архиву и помечает задачу выполненной
+func (ls *LinkService) CompleteTask(taskID, archivePath string) error {
+	ls.mu.Lock()
+	defer ls.mu.Unlock()
+
+	task, exists := ls.store.Get(taskID)
+	if !exists {
+		return fmt.Errorf("%w: %s", ErrTaskNotFound, taskID)
+	}
+
+	if !CanTransition(task.Status, StatusCompleted) {
+		return fmt.Errorf("%w: task %s cannot move from %s to %s", ErrTaskState, taskID, task.Status, StatusCompleted)
+	}
+
+	task.Status = StatusCompleted
+	task.ArchivePath = archivePath
+	return ls.save(task)
+}
+
+// FailTask помечает задачу завершившейся с ошибкой
+func (ls *LinkService) FailTask(taskID string, cause error) error {
+	ls.mu.Lock()
+	defer ls.mu.Unlock()
+
+	task, exists := ls.store.Get(taskID)
+	if !exists {
+		return fmt.Errorf("%w: %s", ErrTaskNotFound, taskID)
+	}
+
+	if !CanTransition(task.Status, StatusFailed) {
+		return fmt.Errorf("%w: task %s cannot move from %s to %s", ErrTaskState, taskID, task.Status, StatusFailed)
+	}
+
+	task.Status = StatusFailed
+	task.Error = cause.Error()
+	return ls.save(task)
+}
+
+// AbortedByShutdown - причина прерывания задач, не успевших завершиться до остановки сервера.
+// Такие задачи Recover снова ставит в очередь при следующем запуске.
+const AbortedByShutdown = "interrupted by shutdown"
+
+// AbortTask помечает задачу прерванной с указанием причины; такую задачу можно запустить снова
+func (ls *LinkService) AbortTask(taskID, reason string) error {
+	ls.mu.Lock()
+	defer ls.mu.Unlock()
+
+	task, exists := ls.store.Get(taskID)
+	if !exists {
+		return fmt.Errorf("%w: %s", ErrTaskNotFound, taskID)
+	}
+
+	if !CanTransition(task.Status, StatusAborted) {
+		return fmt.Errorf("%w: task %s cannot move from %s to %s", ErrTaskState, taskID, task.Status, StatusAborted)
+	}
+
+	task.Status = StatusAborted
+	task.Error = reason
+	return ls.save(task)
+}
+
+// GetWorkspace возвращает рабочую директорию указанной задачи
+func (ls *LinkService) GetWorkspace(taskID string) (string, error) {
+	task, exists := ls.store.Get(taskID)
+	if !exists {
+		return "", fmt.Errorf("%w: %s", ErrTaskNotFound, taskID)
+	}
+
+	return task.Dir, nil
+}
+
+// ClearTask удаляет указанную задачу вместе с её рабочей директорией
 func (ls *LinkService) ClearTask(taskID string) error {
 	ls.mu.Lock()
 	defer ls.mu.Unlock()
 
-	if _, exists := ls.tasks[taskID]; !exists {
-		return fmt.Errorf("task with ID %s not found", taskID)
+	task, exists := ls.store.Get(taskID)
+	if !exists {
+		return fmt.Errorf("%w: %s", ErrTaskNotFound, taskID)
 	}
 
-	delete(ls.tasks, taskID)
+	if err := ls.store.Delete(taskID); err != nil {
+		return err
+	}
+	return removeWorkspace(task)
+}
+
+// removeWorkspace удаляет рабочую директорию задачи со всеми скачанными и временными файлами
+func removeWorkspace(task Task) error {
+	if task.Dir == "" {
+		return nil
+	}
+	if err := os.RemoveAll(task.Dir); err != nil {
+		return fmt.Errorf("failed to remove workspace of task %s: %v", task.ID, err)
+	}
 	return nil
 }
 
-// GetTaskStatus возвращает информацию о задаче
-func (ls *LinkService) GetTaskStatus(taskID string) (int, error) {
-	ls.mu.RLock()
-	defer ls.mu.RUnlock()
+// Close удаляет временные файлы, которые не понадобятся после перезапуска, и закрывает хранилище задач.
+// Чанки и журналы прерванных загрузок остаются, если хранилище сохраняет задачи между запусками:
+// по ним загрузка продолжится с места остановки.
+func (ls *LinkService) Close() error {
+	keepChunks := ls.cfg.Storage.Backend == config.StoreBackendFile
+	for _, task := range ls.store.List() {
+		removeTempFiles(task.Dir, keepChunks)
+	}
+	return ls.store.Close()
+}
 
-	task, exists := ls.tasks[taskID]
-	if !exists {
-		return 0,fmt.Errorf("task with ID %s not found", taskID)
+// removeTempFiles удаляет временные файлы рабочей директории: буферы потоковой архивации,
+// недописанные архивы и, если keepChunks не задан, чанки загрузок с их журналами
+func removeTempFiles(dir string, keepChunks bool) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return
 	}
 
-	return len(task.Links), nil
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || !(strings.HasSuffix(name, ".tmp") || strings.HasSuffix(name, util.JOURNAL_FILE_SUFFIX)) {
+			continue
+		}
+		chunk := strings.HasPrefix(name, util.TMP_FILE_PREFIX+"-") && !strings.HasPrefix(name, util.TMP_FILE_PREFIX+"-stream-")
+		if chunk && keepChunks {
+			continue
+		}
+		if err := os.Remove(filepath.Join(dir, name)); err != nil {
+			log.Printf("Failed to remove temp file %s: %v", name, err)
+		}
+	}
 }
 
 func (ls *LinkService) ActiveTasksCount() int {
-	    ls.mu.RLock()
-    defer ls.mu.RUnlock()
-    
-    count := 0
-    for _, task := range ls.tasks {
-        if task.Status == "processing" {
-            count++
-        }
-    }
-    return count
+	ls.mu.RLock()
+	defer ls.mu.RUnlock()
+	return ls.activeTasksCount()
+}
+
+func (ls *LinkService) activeTasksCount() int {
+	count := 0
+	for _, task := range ls.store.List() {
+		if task.Status.IsActive() {
+			count++
+		}
+	}
+	return count
 }
 
 func (ls *LinkService) AllTasksCount() int {
-	ls.mu.RLock()
-	defer ls.mu.RUnlock()
-	return len(ls.tasks)
+	return len(ls.store.List())
+}
+
+// Recover помечает прерванными задачи, выполнение которых оборвал перезапуск или остановка сервера,
+// и возвращает их ID в порядке создания, чтобы их можно было снова поставить в очередь
+func (ls *LinkService) Recover() []string {
+	ls.mu.Lock()
+	defer ls.mu.Unlock()
+
+	var interrupted []string
+	for _, task := range ls.ListTasks() {
+		switch task.Status {
+		case StatusQueued, StatusDownloading, StatusArchiving:
+		case StatusAborted:
+			if task.Error != AbortedByShutdown {
+				continue
+			}
+		default:
+			continue
+		}
+
+		task.Status = StatusAborted
+		task.Error = "interrupted by server restart"
+		if err := ls.save(task); err != nil {
+			continue
+		}
+		interrupted = append(interrupted, task.ID)
+	}
+	return interrupted
 }
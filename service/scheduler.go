@@ -0,0 +1,175 @@
+package service
+
+import (
+	"context"
+	"strings"
+	"sync"
+)
+
+// ConnScheduler ограничивает число одновременных запросов к серверам-источникам:
+// всего по серверу и к каждому хосту. Запросы, которым не хватило места, ждут в очереди своей задачи,
+// а освободившееся место отдается задачам по кругу, чтобы задача с большим числом чанков
+// не занимала все соединения, пока остальные ждут.
+type ConnScheduler struct {
+	maxTotal   int // 0 - без ограничения
+	maxPerHost int // 0 - без ограничения
+
+	mu      sync.Mutex
+	total   int
+	perHost map[string]int
+	queues  map[string][]*connWaiter // Ожидающие запросы по задачам
+	order   []string                 // Задачи с ожидающими запросами в порядке обхода
+	next    int                      // С какой задачи начинать следующий обход
+}
+
+// connWaiter - запрос, ожидающий места в планировщике
+type connWaiter struct {
+	host    string
+	ready   chan struct{}
+	granted bool
+}
+
+// NewConnScheduler создает планировщик с лимитами соединений всего и на один хост
+func NewConnScheduler(maxTotal, maxPerHost int) *ConnScheduler {
+	return &ConnScheduler{
+		maxTotal:   maxTotal,
+		maxPerHost: maxPerHost,
+		perHost:    make(map[string]int),
+		queues:     make(map[string][]*connWaiter),
+	}
+}
+
+// Acquire ждет места для запроса задачи taskID к хосту host, пока не отменен ctx.
+// Место нужно вернуть вызовом release, когда тело ответа дочитано.
+func (s *ConnScheduler) Acquire(ctx context.Context, taskID, host string) (release func(), err error) {
+	host = strings.ToLower(host)
+	w := &connWaiter{host: host, ready: make(chan struct{})}
+
+	s.mu.Lock()
+	if _, waiting := s.queues[taskID]; !waiting {
+		s.order = append(s.order, taskID)
+	}
+	s.queues[taskID] = append(s.queues[taskID], w)
+	s.dispatch()
+	s.mu.Unlock()
+
+	select {
+	case <-w.ready:
+		return s.releaser(host), nil
+	case <-ctx.Done():
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if w.granted {
+		// Место выдано одновременно с отменой - возвращаем его
+		s.release(host)
+		return nil, ctx.Err()
+	}
+	s.remove(taskID, w)
+	return nil, ctx.Err()
+}
+
+func (s *ConnScheduler) releaser(host string) func() {
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			s.mu.Lock()
+			defer s.mu.Unlock()
+			s.release(host)
+		})
+	}
+}
+
+func (s *ConnScheduler) release(host string) {
+	s.total--
+	if s.perHost[host]--; s.perHost[host] <= 0 {
+		delete(s.perHost, host)
+	}
+	s.dispatch()
+}
+
+// dispatch раздает свободные места ожидающим запросам, обходя задачи по кругу:
+// за один обход каждая задача получает не больше одного места.
+// В очереди задачи пропускаются запросы к хостам, у которых нет свободных мест.
+func (s *ConnScheduler) dispatch() {
+	for len(s.order) > 0 && (s.maxTotal <= 0 || s.total < s.maxTotal) {
+		granted := false
+		for i := 0; i < len(s.order) && (s.maxTotal <= 0 || s.total < s.maxTotal); i++ {
+			if s.next >= len(s.order) {
+				s.next = 0
+			}
+			taskID := s.order[s.next]
+
+			w := s.firstReady(taskID)
+			if w == nil {
+				s.next++
+				continue
+			}
+
+			s.total++
+			s.perHost[w.host]++
+			w.granted = true
+			close(w.ready)
+			granted = true
+
+			// remove сдвигает order, если очередь задачи опустела
+			if !s.remove(taskID, w) {
+				s.next++
+			}
+		}
+		if !granted {
+			return
+		}
+	}
+}
+
+// firstReady возвращает первый запрос задачи к хосту со свободным местом
+func (s *ConnScheduler) firstReady(taskID string) *connWaiter {
+	for _, w := range s.queues[taskID] {
+		if s.maxPerHost <= 0 || s.perHost[w.host] < s.maxPerHost {
+			return w
+		}
+	}
+	return nil
+}
+
+// remove убирает запрос из очереди задачи и сообщает, была ли задача убрана из обхода
+func (s *ConnScheduler) remove(taskID string, w *connWaiter) bool {
+	queue := s.queues[taskID]
+	for i, queued := range queue {
+		if queued == w {
+			queue = append(queue[:i], queue[i+1:]...)
+			break
+		}
+	}
+	if len(queue) > 0 {
+		s.queues[taskID] = queue
+		return false
+	}
+
+	delete(s.queues, taskID)
+	for i, id := range s.order {
+		if id == taskID {
+			s.order = append(s.order[:i], s.order[i+1:]...)
+			if i < s.next {
+				s.next--
+			}
+			break
+		}
+	}
+	return true
+}
+
+type taskKey struct{}
+
+// WithTask помечает ctx задачей, от имени которой выполняются запросы к источникам
+func WithTask(ctx context.Context, taskID string) context.Context {
+	return context.WithValue(ctx, taskKey{}, taskID)
+}
+
+// taskFrom возвращает задачу, которой помечен ctx
+func taskFrom(ctx context.Context) string {
+	taskID, _ := ctx.Value(taskKey{}).(string)
+	return taskID
+}
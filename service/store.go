@@ -0,0 +1,201 @@
+package service
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/vldmir/zip-service/config"
+)
+
+// TaskStore хранит задачи сервиса. Get и List возвращают копии задач,
+// изменения сохраняются только через Put.
+type TaskStore interface {
+	Get(id string) (Task, bool)
+	Put(task Task) error
+	Delete(id string) error
+	List() []Task
+	Close() error // Сохраняет несохраненные изменения и освобождает ресурсы
+}
+
+// NewTaskStore создает хранилище задач, выбранное в storage.backend конфига
+func NewTaskStore(cfg *config.Config) (TaskStore, error) {
+	switch cfg.Storage.Backend {
+	case config.StoreBackendMemory:
+		return NewMemoryStore(), nil
+	case config.StoreBackendFile:
+		return NewFileStore(cfg.Storage.StateFile)
+	}
+	return nil, fmt.Errorf("unknown task store backend %q", cfg.Storage.Backend)
+}
+
+// MemoryStore хранит задачи в памяти процесса; после перезапуска задачи теряются
+type MemoryStore struct {
+	mu    sync.RWMutex
+	tasks map[string]Task
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{tasks: make(map[string]Task)}
+}
+
+func (s *MemoryStore) Get(id string) (Task, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	task, ok := s.tasks[id]
+	if !ok {
+		return Task{}, false
+	}
+	return task.clone(), true
+}
+
+func (s *MemoryStore) Put(task Task) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.tasks[task.ID] = task.clone()
+	return nil
+}
+
+func (s *MemoryStore) Delete(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.tasks, id)
+	return nil
+}
+
+func (s *MemoryStore) List() []Task {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	tasks := make([]Task, 0, len(s.tasks))
+	for _, task := range s.tasks {
+		tasks = append(tasks, task.clone())
+	}
+	return tasks
+}
+
+func (s *MemoryStore) Close() error {
+	return nil
+}
+
+// fileStoreFlushInterval - как часто FileStore записывает накопившиеся изменения на диск
+const fileStoreFlushInterval = time.Second
+
+// FileStore хранит задачи в памяти и сохраняет их в JSON-файл, откуда они восстанавливаются после перезапуска.
+// Прогресс загрузки меняется очень часто, поэтому изменения записываются не чаще раза в fileStoreFlushInterval;
+// файл заменяется атомарно, так что обрыв записи не портит сохраненное состояние.
+type FileStore struct {
+	*MemoryStore
+	path string
+
+	mu    sync.Mutex // Сериализует запись файла
+	dirty chan struct{}
+	stop  chan struct{}
+	done  chan struct{}
+}
+
+// NewFileStore открывает хранилище в файле path, загружая из него сохраненные задачи
+func NewFileStore(path string) (*FileStore, error) {
+	s := &FileStore{
+		MemoryStore: NewMemoryStore(),
+		path:        path,
+		dirty:       make(chan struct{}, 1),
+		stop:        make(chan struct{}),
+		done:        make(chan struct{}),
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("failed to read task store %s: %v", path, err)
+	}
+	if err == nil {
+		var tasks []Task
+		if err := json.Unmarshal(data, &tasks); err != nil {
+			return nil, fmt.Errorf("failed to parse task store %s: %v", path, err)
+		}
+		for _, task := range tasks {
+			s.tasks[task.ID] = task
+		}
+	}
+
+	go s.flushLoop()
+	return s, nil
+}
+
+func (s *FileStore) Put(task Task) error {
+	s.MemoryStore.Put(task)
+	s.markDirty()
+	return nil
+}
+
+func (s *FileStore) Delete(id string) error {
+	s.MemoryStore.Delete(id)
+	s.markDirty()
+	return nil
+}
+
+// Close останавливает фоновую запись и сохраняет последнее состояние задач
+func (s *FileStore) Close() error {
+	close(s.stop)
+	<-s.done
+	return s.flush()
+}
+
+func (s *FileStore) markDirty() {
+	select {
+	case s.dirty <- struct{}{}:
+	default:
+	}
+}
+
+func (s *FileStore) flushLoop() {
+	defer close(s.done)
+
+	ticker := time.NewTicker(fileStoreFlushInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.stop:
+			return
+		case <-ticker.C:
+			select {
+			case <-s.dirty:
+				if err := s.flush(); err != nil {
+					log.Printf("Failed to save tasks: %v", err)
+				}
+			default:
+			}
+		}
+	}
+}
+
+// flush атомарно перезаписывает файл хранилища текущим состоянием задач
+func (s *FileStore) flush() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	data, err := json.MarshalIndent(s.List(), "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode tasks: %v", err)
+	}
+
+	if err := os.MkdirAll(filepath.Dir(s.path), 0755); err != nil {
+		return fmt.Errorf("failed to create task store directory: %v", err)
+	}
+	tmpPath := s.path + ".tmp"
+	if err := os.WriteFile(tmpPath, data, 0644); err != nil {
+		return fmt.Errorf("failed to write task store %s: %v", tmpPath, err)
+	}
+	if err := os.Rename(tmpPath, s.path); err != nil {
+		return fmt.Errorf("failed to replace task store %s: %v", s.path, err)
+	}
+	return nil
+}
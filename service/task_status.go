@@ -0,0 +1,45 @@
+package service
+
+// TaskStatus описывает состояние задачи в конечном автомате
+type TaskStatus string
+
+const (
+	StatusCreated     TaskStatus = "created"     // задача создана, в неё можно добавлять ссылки
+	StatusQueued      TaskStatus = "queued"      // задача ждет свободного воркера
+	StatusDownloading TaskStatus = "downloading" // файлы скачиваются в рабочую директорию
+	StatusArchiving   TaskStatus = "archiving"   // скачанные файлы упаковываются в архив
+	StatusCompleted   TaskStatus = "completed"   // архив готов и лежит на диске
+	StatusFailed      TaskStatus = "failed"      // выполнение завершилось ошибкой
+	StatusCancelled   TaskStatus = "cancelled"   // задача отменена пользователем
+	StatusAborted     TaskStatus = "aborted"     // выполнение прервано, задачу можно продолжить
+)
+
+// transitions перечисляет допустимые переходы между состояниями задачи
+var transitions = map[TaskStatus][]TaskStatus{
+	StatusCreated:     {StatusQueued, StatusCancelled},
+	StatusQueued:      {StatusCreated, StatusDownloading, StatusFailed, StatusCancelled, StatusAborted},
+	StatusDownloading: {StatusArchiving, StatusFailed, StatusCancelled, StatusAborted},
+	StatusArchiving:   {StatusCompleted, StatusFailed, StatusCancelled, StatusAborted},
+	StatusCompleted:   {StatusQueued},
+	StatusFailed:      {StatusQueued},
+	StatusAborted:     {StatusQueued, StatusCancelled},
+}
+
+// CanTransition сообщает, разрешен ли переход задачи из состояния from в состояние to
+func CanTransition(from, to TaskStatus) bool {
+	for _, next := range transitions[from] {
+		if next == to {
+			return true
+		}
+	}
+	return false
+}
+
+// IsActive сообщает, занимает ли задача в этом состоянии слот сервера
+func (s TaskStatus) IsActive() bool {
+	switch s {
+	case StatusCreated, StatusQueued, StatusDownloading, StatusArchiving:
+		return true
+	}
+	return false
+}
@@ -0,0 +1,263 @@
+package service
+
+import (
+	"context"
+	"io"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/vldmir/zip-service/config"
+)
+
+// throttleChunk - сколько байт пропускается за одно ожидание; крупные записи делятся на части,
+// чтобы скорость выравнивалась, а не шла рывками
+const throttleChunk = 32 << 10
+
+// throttleIdle - через сколько без трафика неиспользуемое ведро задачи или хоста удаляется
+const throttleIdle = time.Minute
+
+// Throttle ограничивает скорость передачи данных алгоритмом token bucket:
+// общим ведром на весь сервер, ведром на каждую задачу и на каждый хост-источник.
+// Лимиты можно менять на ходу, новые значения сразу действуют на уже идущие передачи.
+type Throttle struct {
+	mu     sync.Mutex
+	limits config.ThrottleLimits
+	global *bucket
+	tasks  map[string]*bucket
+	hosts  map[string]*bucket
+}
+
+// NewThrottle создает ограничитель скорости с лимитами из конфига
+func NewThrottle(limits config.ThrottleLimits) *Throttle {
+	return &Throttle{
+		limits: limits,
+		global: newBucket(limits.Global),
+		tasks:  make(map[string]*bucket),
+		hosts:  make(map[string]*bucket),
+	}
+}
+
+// Limits возвращает действующие лимиты
+func (t *Throttle) Limits() config.ThrottleLimits {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.limits
+}
+
+// SetLimits заменяет лимиты, в том числе для уже идущих передач
+func (t *Throttle) SetLimits(limits config.ThrottleLimits) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.limits = limits
+	t.global.setRate(limits.Global)
+	for _, b := range t.tasks {
+		b.setRate(limits.PerTask)
+	}
+	for _, b := range t.hosts {
+		b.setRate(limits.PerHost)
+	}
+}
+
+// DownloadWriter ограничивает запись скачиваемого файла задачи taskID из источника rawURL
+// общим лимитом, лимитом задачи и лимитом хоста. Когда передача закончена, нужно вызвать release.
+func (t *Throttle) DownloadWriter(ctx context.Context, taskID, rawURL string, w io.Writer) (io.Writer, func()) {
+	if t == nil {
+		return w, func() {}
+	}
+	buckets, release := t.acquire(true, taskID, hostOf(rawURL))
+	return &throttledWriter{ctx: ctx, w: w, buckets: buckets}, release
+}
+
+// ArchiveWriter ограничивает отдачу архива задачи taskID клиенту общим лимитом и лимитом задачи.
+// Когда передача закончена, нужно вызвать release.
+func (t *Throttle) ArchiveWriter(ctx context.Context, taskID string, w io.Writer) (io.Writer, func()) {
+	if t == nil {
+		return w, func() {}
+	}
+	buckets, release := t.acquire(true, taskID, "")
+	return &throttledWriter{ctx: ctx, w: w, buckets: buckets}, release
+}
+
+// SourceReader ограничивает чтение из источника rawURL только лимитом хоста.
+// Используется при потоковой архивации, где общий лимит и лимит задачи уже действуют на ArchiveWriter.
+// Когда передача закончена, нужно вызвать release.
+func (t *Throttle) SourceReader(ctx context.Context, rawURL string, r io.Reader) (io.Reader, func()) {
+	if t == nil {
+		return r, func() {}
+	}
+	buckets, release := t.acquire(false, "", hostOf(rawURL))
+	return &throttledReader{ctx: ctx, r: r, buckets: buckets}, release
+}
+
+// acquire возвращает ведра, через которые идет передача, и функцию, освобождающую их по её окончании;
+// пустые taskID и host пропускаются. Пока ведро используется, оно не удаляется.
+func (t *Throttle) acquire(global bool, taskID, host string) ([]*bucket, func()) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	var buckets, shared []*bucket
+	if global {
+		buckets = append(buckets, t.global)
+	}
+	if taskID != "" {
+		shared = append(shared, t.bucketFor(t.tasks, taskID, t.limits.PerTask))
+	}
+	if host != "" {
+		shared = append(shared, t.bucketFor(t.hosts, host, t.limits.PerHost))
+	}
+	for _, b := range shared {
+		b.refs++
+	}
+
+	var once sync.Once
+	release := func() {
+		once.Do(func() {
+			t.mu.Lock()
+			defer t.mu.Unlock()
+			for _, b := range shared {
+				b.refs--
+			}
+		})
+	}
+	return append(buckets, shared...), release
+}
+
+// bucketFor возвращает ведро по ключу, создавая его при необходимости,
+// и заодно удаляет ведра, которыми никто не пользуется и через которые давно не шел трафик
+func (t *Throttle) bucketFor(buckets map[string]*bucket, key string, rate int64) *bucket {
+	if b, ok := buckets[key]; ok {
+		return b
+	}
+
+	now := time.Now()
+	for k, b := range buckets {
+		if b.refs == 0 && b.idleSince(now) > throttleIdle {
+			delete(buckets, k)
+		}
+	}
+
+	b := newBucket(rate)
+	buckets[key] = b
+	return b
+}
+
+func hostOf(rawURL string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return ""
+	}
+	return strings.ToLower(u.Hostname())
+}
+
+// bucket - ведро токенов, пополняемое со скоростью rate байт в секунду.
+// Ведро вмещает секунду трафика; долг, взятый сверх накопленного, отрабатывается ожиданием.
+type bucket struct {
+	refs int // Сколько передач используют ведро, под блокировкой Throttle
+
+	mu     sync.Mutex
+	rate   float64 // 0 - без ограничения
+	tokens float64
+	last   time.Time
+}
+
+func newBucket(rate int64) *bucket {
+	return &bucket{rate: float64(rate), tokens: float64(rate), last: time.Now()}
+}
+
+func (b *bucket) setRate(rate int64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.refill(time.Now())
+	b.rate = float64(rate)
+	if b.rate <= 0 || b.tokens > b.rate {
+		b.tokens = b.rate
+	}
+}
+
+// take списывает n байт и возвращает, сколько нужно подождать перед их передачей
+func (b *bucket) take(n int) time.Duration {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	now := time.Now()
+	b.refill(now)
+	if b.rate <= 0 {
+		return 0
+	}
+	b.tokens -= float64(n)
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / b.rate * float64(time.Second))
+}
+
+func (b *bucket) refill(now time.Time) {
+	if b.rate > 0 {
+		b.tokens = min(b.tokens+now.Sub(b.last).Seconds()*b.rate, b.rate)
+	}
+	b.last = now
+}
+
+func (b *bucket) idleSince(now time.Time) time.Duration {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return now.Sub(b.last)
+}
+
+// wait списывает n байт со всех ведер и ждет, пока их можно будет передать
+func wait(ctx context.Context, buckets []*bucket, n int) error {
+	var delay time.Duration
+	for _, b := range buckets {
+		delay = max(delay, b.take(n))
+	}
+	if delay <= 0 {
+		return ctx.Err()
+	}
+	return Sleep(ctx, delay)
+}
+
+type throttledWriter struct {
+	ctx     context.Context
+	w       io.Writer
+	buckets []*bucket
+}
+
+func (t *throttledWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		n := min(len(p), throttleChunk)
+		if err := wait(t.ctx, t.buckets, n); err != nil {
+			return written, err
+		}
+		m, err := t.w.Write(p[:n])
+		written += m
+		if err != nil {
+			return written, err
+		}
+		p = p[n:]
+	}
+	return written, nil
+}
+
+type throttledReader struct {
+	ctx     context.Context
+	r       io.Reader
+	buckets []*bucket
+}
+
+func (t *throttledReader) Read(p []byte) (int, error) {
+	if len(p) > throttleChunk {
+		p = p[:throttleChunk]
+	}
+	n, err := t.r.Read(p)
+	if n > 0 {
+		if werr := wait(t.ctx, t.buckets, n); werr != nil {
+			return n, werr
+		}
+	}
+	return n, err
+}
@@ -4,11 +4,14 @@ package util
 const DEFAUTL_STR = ""
 
 
-// worker
-const WORKER_ROUTINES = 10 
-
 // file
 const TMP_FILE_PREFIX = "tmpfile"
+const JOURNAL_FILE_SUFFIX = ".journal"
+const MAX_FILE_NAME_LEN = 200 // Максимальная длина имени файла в архиве, в байтах
 
 // header
 const CONTENT_LENGTH_HEADER = "Content-Length"
+const ACCEPT_RANGES_HEADER = "Accept-Ranges"
+
+// sniffing
+const SNIFF_LEN = 512 // Сколько первых байт файла анализируется для определения типа
@@ -4,6 +4,8 @@ import (
 	"fmt"
 	"net/url"
 	"path"
+	"strings"
+	"unicode/utf8"
 )
 
 func ExtractFileName(urlStr string) (string, error) {
@@ -19,3 +21,59 @@ func ExtractFileName(urlStr string) (string, error) {
 
 	return fileName, nil
 }
+
+// windowsReserved - имена устройств, которые нельзя использовать как имя файла в Windows
+var windowsReserved = map[string]bool{
+	"CON": true, "PRN": true, "AUX": true, "NUL": true,
+	"COM1": true, "COM2": true, "COM3": true, "COM4": true, "COM5": true, "COM6": true, "COM7": true, "COM8": true, "COM9": true,
+	"LPT1": true, "LPT2": true, "LPT3": true, "LPT4": true, "LPT5": true, "LPT6": true, "LPT7": true, "LPT8": true, "LPT9": true,
+}
+
+// SanitizeFileName приводит имя файла к безопасному виду: убирает путь (защита от path traversal),
+// управляющие и зарезервированные символы, зарезервированные имена Windows и ограничивает длину.
+// Возвращает пустую строку, если от имени ничего не осталось.
+func SanitizeFileName(name string) string {
+	name = strings.ToValidUTF8(name, "_")
+	name = path.Base(strings.ReplaceAll(name, "\\", "/"))
+	name = strings.Map(func(r rune) rune {
+		if r < 0x20 || r == 0x7f || strings.ContainsRune(`<>:"/\|?*`, r) {
+			return '_'
+		}
+		return r
+	}, name)
+	name = strings.Trim(name, " .")
+	if name == "" {
+		return ""
+	}
+
+	ext := path.Ext(name)
+	base := strings.TrimSuffix(name, ext)
+	if windowsReserved[strings.ToUpper(base)] {
+		base = "_" + base
+	}
+
+	// Обрезаем длинное имя, сохраняя расширение и не разрывая UTF-8 символы
+	if len(ext) > MAX_FILE_NAME_LEN/2 {
+		ext = ""
+	}
+	for len(base)+len(ext) > MAX_FILE_NAME_LEN {
+		_, size := utf8.DecodeLastRuneInString(base)
+		base = base[:len(base)-size]
+	}
+	return base + ext
+}
+
+// UniqueName возвращает name, а если оно уже занято - "name (1).ext", "name (2).ext" и т.д.,
+// и отмечает выбранное имя занятым. Имена сравниваются без учета регистра,
+// чтобы записи архива не перезаписывали друг друга при распаковке.
+func UniqueName(name string, used map[string]bool) string {
+	ext := path.Ext(name)
+	base := strings.TrimSuffix(name, ext)
+
+	candidate := name
+	for i := 1; used[strings.ToLower(candidate)]; i++ {
+		candidate = fmt.Sprintf("%s (%d)%s", base, i, ext)
+	}
+	used[strings.ToLower(candidate)] = true
+	return candidate
+}